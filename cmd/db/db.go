@@ -1,73 +1,729 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/roman-mazur/design-practice-2-template/datastore"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
-	"io/ioutil"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var port = flag.Int("port", 8083, "server port")
+// Every flag can also be set with an environment variable named after it,
+// e.g. DB_DATA_DIR for --data-dir. Command line values take precedence.
+const envPrefix = "DB_"
+
+var (
+	port             = flag.Int("port", 8083, "server port")
+	dataDir          = flag.String("data-dir", "data", "directory with segment files, created if missing")
+	segmentSize      = flag.Int64("segment-size", 10*1024*1024, "segment file size in bytes")
+	compactThreshold = flag.Int("compact-threshold", 3, "number of segments that triggers compaction")
+	syncMode         = flag.String("sync", "none", "when to fsync writes: none, always, group or an interval like 100ms")
+	fileMode         = flag.String("file-mode", "644", "permissions of segment files (octal)")
+	maxKeySize       = flag.Int("max-key-size", 0, "max key size in bytes, 0 for no limit")
+	maxValueSize     = flag.Int("max-value-size", 0, "max value size in bytes, 0 for no limit")
+	compactInterval  = flag.Duration("compact-interval", time.Minute, "how often to check for garbage to compact, 0 to disable")
+	garbageRatio     = flag.Float64("garbage-ratio", 0.5, "share of shadowed records that triggers scheduled compaction")
+	compressMin      = flag.Int("compress-min-size", 0, "compress values of at least this many bytes with DEFLATE, 0 to disable")
+	encryptionKeys   = flag.String("encryption-keys", "", "comma separated id:hex-key AES keys to encrypt segments with, the last one is current")
+	encryptionFile   = flag.String("encryption-keys-file", "", "file with id:hex-key AES keys, one per line, the last one is current")
+	useMmap          = flag.Bool("mmap", false, "map segment files into memory for reads (Linux only)")
+	bloomRate        = flag.Float64("bloom-fp-rate", 0.01, "false positive rate of per-segment Bloom filters, 0 to disable")
+	indexBlockSize   = flag.Int("index-block-size", 0, "keep indexes of sealed segments on disk in blocks of this many bytes, 0 to keep them in memory")
+	snapshotTTL      = flag.Duration("snapshot-ttl", 5*time.Minute, "how long a snapshot created over HTTP is kept without being read")
+)
 
 type RespBody struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
 }
 
+// ReqBody is the body of POST /db/<key>. TTL is an optional Go duration such
+// as "90s" after which the key expires.
 type ReqBody struct {
-	Value string `json:"value"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	TTL   string          `json:"ttl,omitempty"`
+}
+
+// BatchOp is one operation of a POST /db/_batch request, Op is "put" or
+// "delete".
+type BatchOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type IncrBody struct {
+	Delta *int64 `json:"delta"`
+}
+
+type ScanBody struct {
+	Items []RespBody `json:"items"`
+	// Next is the cursor to pass as after to get the next page, it is empty
+	// on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+type CompactionStatsBody struct {
+	Started      time.Time `json:"started"`
+	DurationMs   int64     `json:"durationMs"`
+	Segments     int       `json:"segments"`
+	BytesRead    int64     `json:"bytesRead"`
+	BytesWritten int64     `json:"bytesWritten"`
+	KeysDropped  int       `json:"keysDropped"`
+}
+
+type CompressionStatsBody struct {
+	Values      int64   `json:"values"`
+	Compressed  int64   `json:"compressed"`
+	RawBytes    int64   `json:"rawBytes"`
+	StoredBytes int64   `json:"storedBytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+type BloomStatsBody struct {
+	Hits              int64   `json:"hits"`
+	Misses            int64   `json:"misses"`
+	FalsePositives    int64   `json:"falsePositives"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+type CompactionStatusBody struct {
+	Running      bool                 `json:"running"`
+	GarbageRatio float64              `json:"garbageRatio"`
+	Last         *CompactionStatsBody `json:"last"`
 }
 
 func main() {
+	if err := applyEnv(); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+	if *snapshotTTL <= 0 {
+		log.Fatalf("snapshot-ttl must be positive, got %s", *snapshotTTL)
+	}
+
 	h := new(http.ServeMux)
-	dir, err := ioutil.TempDir("", "temp-dir")
+	Db, err := openDb()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Db, err := datastore.NewDb(dir, 250)
 	defer Db.Close()
+	snaps := newSnapshots(*snapshotTTL)
+	defer snaps.close()
 
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		url := req.URL.String()
-		key := url[4:]
+		key := strings.TrimPrefix(req.URL.Path, "/db/")
+		if key == "_batch" && req.Method == "POST" {
+			writeBatch(rw, req, Db)
+			return
+		}
+		if incrKey := strings.TrimSuffix(key, "/incr"); incrKey != key && req.Method == "POST" {
+			increment(rw, req, Db, incrKey)
+			return
+		}
 
 		switch req.Method {
 		case "GET":
-			value, err := Db.Get(key)
+			r, err := snaps.reader(Db, req)
 			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
+				rw.WriteHeader(readStatus(err))
 				return
 			}
-			rw.WriteHeader(http.StatusOK)
-			rw.Header().Set("content-type", "application/json")
-			_ = json.NewEncoder(rw).Encode(RespBody{
-				Key:   key,
-				Value: value,
-			})
+			writeValue(rw, r, key)
 		case "POST":
-			var body ReqBody
-
-			err := json.NewDecoder(req.Body).Decode(&body)
+			expected, conditional, err := precondition(req)
 			if err != nil {
 				rw.WriteHeader(http.StatusBadRequest)
+				return
 			}
-
-			err = Db.Put(key, body.Value)
-			if err != nil {
+			value, ttl, err := readValue(rw, req)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if conditional && ttl != 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if conditional {
+				var version uint64
+				version, err = putIf(Db, key, value, expected)
+				if err == nil {
+					rw.Header().Set("ETag", formatETag(version))
+				}
+			} else {
+				err = put(Db, key, value, ttl)
+			}
+			if errors.Is(err, datastore.ErrVersionMismatch) {
+				rw.WriteHeader(http.StatusPreconditionFailed)
+				return
+			} else if errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 			rw.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			err := Db.Delete(key)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
 		default:
 			rw.WriteHeader(http.StatusBadRequest)
 		}
 	})
 
+	h.HandleFunc("/db", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		limit := defaultScanLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > maxScanLimit {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		r, err := snaps.reader(Db, req)
+		if err != nil {
+			rw.WriteHeader(readStatus(err))
+			return
+		}
+		resp, err := scan(r, query.Get("prefix"), query.Get("after"), limit)
+		if err != nil {
+			rw.WriteHeader(readStatus(err))
+			return
+		}
+		writeJson(rw, resp)
+	})
+
+	h.HandleFunc("/admin/snapshots", snaps.handle(Db))
+	h.HandleFunc("/admin/snapshots/", snaps.handle(Db))
+	h.HandleFunc("/admin/compact", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := Db.Compact(req.Context())
+		if err != nil {
+			log.Printf("Compaction failed: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJson(rw, compactionStatsBody(stats))
+	})
+	h.HandleFunc("/admin/compaction", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status := Db.CompactionStatus()
+		body := CompactionStatusBody{
+			Running:      status.Running,
+			GarbageRatio: status.GarbageRatio,
+		}
+		if status.Last != nil {
+			last := compactionStatsBody(*status.Last)
+			body.Last = &last
+		}
+		writeJson(rw, body)
+	})
+	h.HandleFunc("/admin/compression", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats := Db.CompressionStats()
+		writeJson(rw, CompressionStatsBody{
+			Values:      stats.Values,
+			Compressed:  stats.Compressed,
+			RawBytes:    stats.RawBytes,
+			StoredBytes: stats.StoredBytes,
+			Ratio:       stats.Ratio(),
+		})
+	})
+	h.HandleFunc("/admin/bloom", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats := Db.BloomStats()
+		writeJson(rw, BloomStatsBody{
+			Hits:              stats.Hits,
+			Misses:            stats.Misses,
+			FalsePositives:    stats.FalsePositives,
+			FalsePositiveRate: stats.FalsePositiveRate(),
+		})
+	})
+
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+var errUnknownType = errors.New("unknown value type")
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// applyEnv sets flag defaults from DB_* environment variables.
+func applyEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("bad value %q of %s: %w", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// checkWritable creates dir if needed and makes sure files can be created in
+// it, so that a misconfigured volume fails at startup rather than on the first
+// write.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create data directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".write-check")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %w", dir, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// openDb opens the datastore configured by the command line flags.
+func openDb() (*datastore.Db, error) {
+	dir := *dataDir
+	if err := checkWritable(dir); err != nil {
+		return nil, err
+	}
+	mode, err := datastore.ParseSyncMode(*syncMode)
+	if err != nil {
+		return nil, err
+	}
+	perm, err := strconv.ParseUint(*fileMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad file mode %q: %w", *fileMode, err)
+	}
+
+	opts := []datastore.Option{
+		datastore.WithSegmentSize(*segmentSize),
+		datastore.WithCompactionThreshold(*compactThreshold),
+		datastore.WithCompactionInterval(*compactInterval),
+		datastore.WithGarbageRatio(*garbageRatio),
+		datastore.WithSyncMode(mode),
+		datastore.WithFileMode(os.FileMode(perm)),
+		datastore.WithMaxKeySize(*maxKeySize),
+		datastore.WithMaxValueSize(*maxValueSize),
+		datastore.WithMmap(*useMmap),
+		datastore.WithBloomFilter(*bloomRate),
+		datastore.WithDiskIndex(*indexBlockSize),
+		datastore.WithLogger(log.Default()),
+	}
+	if *compressMin > 0 {
+		opts = append(opts, datastore.WithCompression(datastore.FlateCodec, *compressMin))
+	}
+	keys, err := loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		opts = append(opts, datastore.WithEncryption(keys))
+	}
+
+	log.Printf("Opening datastore in %s", dir)
+	return datastore.Open(dir, opts...)
+}
+
+// loadKeys returns the encryption keys given by --encryption-keys or read from
+// --encryption-keys-file, nil if neither is set.
+func loadKeys() (datastore.KeyProvider, error) {
+	switch {
+	case *encryptionKeys != "" && *encryptionFile != "":
+		return nil, errors.New("only one of --encryption-keys and --encryption-keys-file can be set")
+	case *encryptionKeys != "":
+		return datastore.ParseKeyRing(*encryptionKeys)
+	case *encryptionFile != "":
+		data, err := os.ReadFile(*encryptionFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read encryption keys: %w", err)
+		}
+		return datastore.ParseKeyRing(string(data))
+	}
+	return nil, nil
+}
+
+func get(db reader, key string) (*RespBody, uint64, error) {
+	value, version, err := db.GetWithVersion(key)
+	var mismatch *datastore.TypeMismatchError
+	if errors.As(err, &mismatch) && mismatch.Actual == datastore.TypeInt64 {
+		n, version, err := db.GetInt64WithVersion(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &RespBody{Key: key, Type: datastore.TypeInt64.String(), Value: n}, version, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return &RespBody{Key: key, Type: datastore.TypeString.String(), Value: value}, version, nil
+}
+
+// writeValue writes the value of the key. Binary values are streamed as
+// application/octet-stream, others are encoded as a JSON RespBody.
+func writeValue(rw http.ResponseWriter, db reader, key string) {
+	value, err := db.GetReader(key)
+	if err != nil {
+		rw.WriteHeader(readStatus(err))
+		return
+	}
+	if value.Type() == datastore.TypeBytes {
+		streamValue(rw, key, value)
+		return
+	}
+	value.Close()
+
+	resp, version, err := get(db, key)
+	var mismatch *datastore.TypeMismatchError
+	if errors.As(err, &mismatch) && mismatch.Actual == datastore.TypeBytes {
+		// The key was overwritten with a binary value meanwhile.
+		writeValue(rw, db, key)
+		return
+	} else if err != nil {
+		rw.WriteHeader(readStatus(err))
+		return
+	}
+	if version != 0 {
+		rw.Header().Set("ETag", formatETag(version))
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+// readStatus is the status of a response to a read that failed with err: a
+// missing key is not found, a snapshot that was released or expired is gone.
+func readStatus(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrSnapshotReleased):
+		return http.StatusGone
+	case errors.Is(err, errUnknownSnapshot):
+		return http.StatusBadRequest
+	default:
+		log.Printf("Read failed: %s", err)
+		return http.StatusInternalServerError
+	}
+}
+
+// streamValue writes a binary value as application/octet-stream without
+// loading it into memory and closes it.
+func streamValue(rw http.ResponseWriter, key string, value *datastore.ValueReader) {
+	defer value.Close()
+	rw.Header().Set("ETag", formatETag(value.Version()))
+	rw.Header().Set("content-type", "application/octet-stream")
+	rw.Header().Set("content-length", strconv.FormatInt(value.Size(), 10))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw, value); err != nil {
+		log.Printf("Failed to stream value of %s: %s", key, err)
+	}
+}
+
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+var errBadPrecondition = errors.New("unsupported precondition")
+
+// precondition returns the version a conditional write expects: the one from
+// If-Match, datastore.AnyVersion for "If-Match: *" which only allows replacing
+// an existing key, or zero for "If-None-Match: *" which only allows creating
+// the key.
+func precondition(req *http.Request) (uint64, bool, error) {
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	switch {
+	case ifMatch != "" && ifNoneMatch != "":
+		return 0, false, errBadPrecondition
+	case ifNoneMatch == "*":
+		return 0, true, nil
+	case ifNoneMatch != "":
+		return 0, false, errBadPrecondition
+	case ifMatch == "*":
+		return datastore.AnyVersion, true, nil
+	case ifMatch != "":
+		tag, err := strconv.Unquote(strings.TrimPrefix(ifMatch, "W/"))
+		if err != nil {
+			return 0, false, errBadPrecondition
+		}
+		version, err := strconv.ParseUint(tag, 10, 64)
+		if err != nil || version == 0 {
+			return 0, false, errBadPrecondition
+		}
+		return version, true, nil
+	}
+	return 0, false, nil
+}
+
+// scan returns up to limit keys with the prefix that sort after the cursor.
+func scan(db reader, prefix, after string, limit int) (*ScanBody, error) {
+	from := ""
+	if after != "" {
+		// The smallest key greater than after.
+		from = after + "\x00"
+	}
+	it := db.Scan(prefix, from, limit+1)
+	defer it.Close()
+
+	resp := &ScanBody{Items: []RespBody{}}
+	for it.Next() {
+		if len(resp.Items) == limit {
+			resp.Next = resp.Items[limit-1].Key
+			break
+		}
+		resp.Items = append(resp.Items, RespBody{Key: it.Key(), Type: it.Type().String(), Value: it.Value()})
+	}
+	return resp, it.Err()
+}
+
+var errBadTTL = errors.New("ttl must be a positive duration")
+
+// parseTTL parses the ttl of a request, an empty one means no expiry.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, errBadTTL
+	}
+	return ttl, nil
+}
+
+// readValue returns the value of a POST request and its ttl. A body of type
+// application/octet-stream is stored as is with the ttl taken from the query,
+// any other body is a JSON ReqBody. A binary body longer than -max-value-size
+// fails with *http.MaxBytesError.
+func readValue(rw http.ResponseWriter, req *http.Request) (interface{}, time.Duration, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/octet-stream" {
+		ttl, err := parseTTL(req.URL.Query().Get("ttl"))
+		if err != nil {
+			return nil, 0, err
+		}
+		limit := int64(*maxValueSize)
+		var buf bytes.Buffer
+		if limit > 0 {
+			req.Body = http.MaxBytesReader(rw, req.Body, limit)
+			// Content-Length is only trusted up to the limit.
+			if req.ContentLength > 0 && req.ContentLength <= limit {
+				buf.Grow(int(req.ContentLength))
+			}
+		}
+		_, err = buf.ReadFrom(req.Body)
+		return buf.Bytes(), ttl, err
+	}
+
+	var body ReqBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, 0, err
+	}
+	ttl, err := parseTTL(body.TTL)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := decodeValue(body)
+	return value, ttl, err
+}
+
+// put stores the value, expiring it after ttl unless ttl is zero.
+func put(db *datastore.Db, key string, value interface{}, ttl time.Duration) error {
+	switch value := value.(type) {
+	case int64:
+		if ttl != 0 {
+			return db.PutInt64WithTTL(key, value, ttl)
+		}
+		return db.PutInt64(key, value)
+	case []byte:
+		if ttl != 0 {
+			return db.PutBytesWithTTL(key, value, ttl)
+		}
+		return db.PutBytes(key, value)
+	default:
+		if ttl != 0 {
+			return db.PutWithTTL(key, value.(string), ttl)
+		}
+		return db.Put(key, value.(string))
+	}
+}
+
+// putIf stores the value only if the key has the expected version.
+func putIf(db *datastore.Db, key string, value interface{}, expected uint64) (uint64, error) {
+	switch value := value.(type) {
+	case int64:
+		return db.CompareAndSwapInt64(key, expected, value)
+	case []byte:
+		return db.CompareAndSwapBytes(key, expected, value)
+	default:
+		return db.CompareAndSwap(key, expected, value.(string))
+	}
+}
+
+// decodeValue returns the value of the request as a string, an int64 or, for
+// base64 encoded binary values, a []byte.
+func decodeValue(body ReqBody) (interface{}, error) {
+	valueType, err := datastore.ParseValueType(body.Type)
+	if err != nil {
+		return nil, errUnknownType
+	}
+	switch valueType {
+	case datastore.TypeInt64:
+		var value int64
+		err := json.Unmarshal(body.Value, &value)
+		return value, err
+	case datastore.TypeBytes:
+		var value []byte
+		err := json.Unmarshal(body.Value, &value)
+		return value, err
+	default:
+		var value string
+		err := json.Unmarshal(body.Value, &value)
+		return value, err
+	}
+}
+
+var errUnknownOp = errors.New("unknown batch operation")
+
+// writeBatch applies the operations of the request body atomically.
+func writeBatch(rw http.ResponseWriter, req *http.Request, db *datastore.Db) {
+	var ops []BatchOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var b datastore.Batch
+	for _, op := range ops {
+		if err := addToBatch(&b, op); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	err := db.Write(&b)
+	if errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) ||
+		errors.Is(err, datastore.ErrBatchTooLarge) {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func addToBatch(b *datastore.Batch, op BatchOp) error {
+	switch op.Op {
+	case "put":
+		value, err := decodeValue(ReqBody{Type: op.Type, Value: op.Value})
+		if err != nil {
+			return err
+		}
+		switch value := value.(type) {
+		case int64:
+			b.PutInt64(op.Key, value)
+		case []byte:
+			b.PutBytes(op.Key, value)
+		default:
+			b.Put(op.Key, value.(string))
+		}
+	case "delete":
+		b.Delete(op.Key)
+	default:
+		return errUnknownOp
+	}
+	return nil
+}
+
+// increment adds the delta from the request body (1 by default) to the key.
+func increment(rw http.ResponseWriter, req *http.Request, db *datastore.Db, key string) {
+	var body IncrBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	delta := int64(1)
+	if body.Delta != nil {
+		delta = *body.Delta
+	}
+
+	value, err := db.Increment(key, delta)
+	var mismatch *datastore.TypeMismatchError
+	if errors.As(err, &mismatch) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(RespBody{
+		Key:   key,
+		Type:  datastore.TypeInt64.String(),
+		Value: value,
+	})
+}
+
+func compactionStatsBody(stats datastore.CompactionStats) CompactionStatsBody {
+	return CompactionStatsBody{
+		Started:      stats.Started,
+		DurationMs:   stats.Duration.Milliseconds(),
+		Segments:     stats.Segments,
+		BytesRead:    stats.BytesRead,
+		BytesWritten: stats.BytesWritten,
+		KeysDropped:  stats.KeysDropped,
+	}
+}
+
+func writeJson(rw http.ResponseWriter, body interface{}) {
+	writeJsonStatus(rw, http.StatusOK, body)
+}
+
+func writeJsonStatus(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reader is implemented by both the database and its snapshots.
+type reader interface {
+	GetWithVersion(key string) (string, uint64, error)
+	GetInt64WithVersion(key string) (int64, uint64, error)
+	GetReader(key string) (*datastore.ValueReader, error)
+	Scan(prefix, from string, limit int) *datastore.Iterator
+}
+
+type SnapshotBody struct {
+	Id string `json:"id"`
+}
+
+// snapshots keeps snapshots created over HTTP until clients release them or
+// their lease runs out. Every read through a snapshot renews its lease, so a
+// snapshot is released after ttl without use by a sweeper.
+type snapshots struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	lastId int
+	byId   map[string]*leasedSnapshot
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type leasedSnapshot struct {
+	snapshot  *datastore.Snapshot
+	expiresAt time.Time
+}
+
+func newSnapshots(ttl time.Duration) *snapshots {
+	s := &snapshots{
+		ttl:  ttl,
+		byId: make(map[string]*leasedSnapshot),
+		done: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.sweep()
+	return s
+}
+
+// sweep releases snapshots with expired leases until close is called.
+func (s *snapshots) sweep() {
+	defer s.wg.Done()
+	interval := s.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.releaseExpired(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *snapshots) releaseExpired(now time.Time) {
+	var expired []*datastore.Snapshot
+	s.mu.Lock()
+	for id, l := range s.byId {
+		if !now.Before(l.expiresAt) {
+			expired = append(expired, l.snapshot)
+			delete(s.byId, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, snapshot := range expired {
+		snapshot.Release()
+	}
+}
+
+// close stops the sweeper and releases all snapshots left.
+func (s *snapshots) close() {
+	close(s.done)
+	s.wg.Wait()
+	s.mu.Lock()
+	left := s.byId
+	s.byId = make(map[string]*leasedSnapshot)
+	s.mu.Unlock()
+	for _, l := range left {
+		l.snapshot.Release()
+	}
+}
+
+func (s *snapshots) create(db *datastore.Db) (string, error) {
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastId++
+	id := strconv.Itoa(s.lastId)
+	s.byId[id] = &leasedSnapshot{snapshot: snapshot, expiresAt: time.Now().Add(s.ttl)}
+	return id, nil
+}
+
+var errUnknownSnapshot = errors.New("unknown snapshot")
+
+// get returns the snapshot and renews its lease. It fails with
+// datastore.ErrSnapshotReleased for a snapshot that was released or expired.
+func (s *snapshots) get(id string) (*datastore.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.byId[id]
+	if !ok {
+		if n, err := strconv.Atoi(id); err == nil && n > 0 && n <= s.lastId {
+			return nil, datastore.ErrSnapshotReleased
+		}
+		return nil, errUnknownSnapshot
+	}
+	l.expiresAt = time.Now().Add(s.ttl)
+	return l.snapshot, nil
+}
+
+func (s *snapshots) release(id string) bool {
+	s.mu.Lock()
+	l, ok := s.byId[id]
+	delete(s.byId, id)
+	s.mu.Unlock()
+	if ok {
+		l.snapshot.Release()
+	}
+	return ok
+}
+
+// reader returns the snapshot named by the snapshot query parameter of req or
+// db itself when there is none.
+func (s *snapshots) reader(db *datastore.Db, req *http.Request) (reader, error) {
+	id := req.URL.Query().Get("snapshot")
+	if id == "" {
+		return db, nil
+	}
+	snapshot, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// handle serves POST /admin/snapshots and DELETE /admin/snapshots/<id>.
+func (s *snapshots) handle(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/snapshots"), "/")
+		switch {
+		case req.Method == "POST" && id == "":
+			id, err := s.create(db)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJsonStatus(rw, http.StatusCreated, SnapshotBody{Id: id})
+		case req.Method == "DELETE" && id != "":
+			if !s.release(id) {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Command dbtool inspects and repairs a datastore data directory. It works on
+// the files directly, so the directory must not be used by a running server.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: dbtool <command> [flags]
+
+Commands:
+  ls-segments  list segment files with their sizes, key counts and garbage ratio
+  dump         print records of segments as JSON lines
+  verify       check checksums of all records, exit with status 1 on corruption
+  repair       move corrupted records of segments to the quarantine directory
+  compact      open the datastore and merge its sealed segments
+
+Run dbtool <command> -h for the flags of a command.
+`
+
+// RecordLine is a record printed by dump.
+type RecordLine struct {
+	Segment    string      `json:"segment"`
+	Offset     int64       `json:"offset"`
+	Size       int64       `json:"size"`
+	Kind       string      `json:"kind,omitempty"`
+	Key        string      `json:"key,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	Compressed bool        `json:"compressed,omitempty"`
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	Seq        uint64      `json:"seq,omitempty"`
+	ExpiresAt  *time.Time  `json:"expiresAt,omitempty"`
+	BatchSize  int         `json:"batchSize,omitempty"`
+	// Checksum is "ok" or the reason the record is invalid.
+	Checksum string `json:"checksum"`
+}
+
+type RepairBody struct {
+	Segment          string `json:"segment"`
+	Kept             int    `json:"kept"`
+	Quarantined      int    `json:"quarantined"`
+	QuarantinedBytes int64  `json:"quarantinedBytes"`
+	QuarantinePath   string `json:"quarantinePath,omitempty"`
+}
+
+type CompactionStatsBody struct {
+	DurationMs   int64 `json:"durationMs"`
+	Segments     int   `json:"segments"`
+	BytesRead    int64 `json:"bytesRead"`
+	BytesWritten int64 `json:"bytesWritten"`
+	KeysDropped  int   `json:"keysDropped"`
+}
+
+var commands = map[string]func(args []string) error{
+	"ls-segments": lsSegments,
+	"dump":        dump,
+	"verify":      verify,
+	"repair":      repair,
+	"compact":     compact,
+}
+
+// errCorrupted makes dbtool exit with status 1 without logging anything else.
+type errCorrupted struct{}
+
+func (errCorrupted) Error() string {
+	return "corrupted records found"
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err == (errCorrupted{}) {
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newFlagSet returns flags of a command with the data directory and the
+// encryption key flags shared by all of them. The returned function builds the
+// datastore options from the parsed key flags.
+func newFlagSet(name string) (*flag.FlagSet, *string, func() ([]datastore.Option, error)) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dir := fs.String("data-dir", "data", "directory with segment files")
+	keys := fs.String("encryption-keys", os.Getenv("DB_ENCRYPTION_KEYS"), "comma separated id:hex-key AES keys of encrypted segments")
+	keysFile := fs.String("encryption-keys-file", os.Getenv("DB_ENCRYPTION_KEYS_FILE"), "file with id:hex-key AES keys, one per line")
+	options := func() ([]datastore.Option, error) {
+		text := *keys
+		if *keysFile != "" {
+			data, err := os.ReadFile(*keysFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read encryption keys: %w", err)
+			}
+			text = string(data)
+		}
+		if text == "" {
+			return nil, nil
+		}
+		ring, err := datastore.ParseKeyRing(text)
+		if err != nil {
+			return nil, err
+		}
+		return []datastore.Option{datastore.WithEncryption(ring)}, nil
+	}
+	return fs, dir, options
+}
+
+func lsSegments(args []string) error {
+	fs, dir, options := newFlagSet("ls-segments")
+	fs.Parse(args)
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	segments, err := datastore.ListSegments(*dir, opts...)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tSTATE\tSIZE\tCHECKSUM\tKEY ID\tRECORDS\tKEYS\tGARBAGE\tCORRUPTED")
+	for _, s := range segments {
+		keyID := "-"
+		if s.Encrypted {
+			keyID = strconv.FormatUint(uint64(s.KeyID), 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%.2f\t%d\n", filepath.Base(s.Path), segmentState(s), s.Size,
+			s.Checksum, keyID, s.Records, s.Keys, s.GarbageRatio, s.Corrupted)
+	}
+	return w.Flush()
+}
+
+func segmentState(s datastore.SegmentInfo) string {
+	switch {
+	case !s.Listed:
+		return "unlisted"
+	case s.Active:
+		return "active"
+	default:
+		return "sealed"
+	}
+}
+
+func dump(args []string) error {
+	fs, dir, options := newFlagSet("dump")
+	segment := fs.String("segment", "", "file name of the segment to dump, all segments by default")
+	values := fs.Bool("values", true, "include values")
+	fs.Parse(args)
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	paths, err := segmentPaths(*dir, *segment, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range paths {
+		err := datastore.ScanSegment(path, func(r datastore.Record) error {
+			return enc.Encode(recordLine(filepath.Base(path), r, *values))
+		}, opts...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func recordLine(segment string, r datastore.Record, values bool) RecordLine {
+	line := RecordLine{
+		Segment:  segment,
+		Offset:   r.Offset,
+		Size:     r.Size,
+		Checksum: "ok",
+	}
+	if r.Err != nil {
+		line.Checksum = r.Err.Error()
+		return line
+	}
+	line.Kind = r.Kind.String()
+	line.Key = r.Key
+	line.Seq = r.Seq
+	line.Compressed = r.Compressed
+	line.Encrypted = r.Encrypted
+	if r.ExpiresAt != 0 {
+		expiresAt := time.Unix(0, r.ExpiresAt).UTC()
+		line.ExpiresAt = &expiresAt
+	}
+	switch r.Kind {
+	case datastore.RecordBatch:
+		line.BatchSize = r.BatchSize()
+	case datastore.RecordValue:
+		line.Type = r.Type.String()
+		// Values of encrypted records are only known with their key.
+		if values && (!r.Encrypted || r.Key != "") {
+			value, err := r.TypedValue()
+			if err != nil {
+				line.Checksum = err.Error()
+			}
+			line.Value = value
+		}
+	}
+	return line
+}
+
+func verify(args []string) error {
+	fs, dir, options := newFlagSet("verify")
+	fs.Parse(args)
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	paths, err := segmentPaths(*dir, "", opts)
+	if err != nil {
+		return err
+	}
+	corrupted, records := 0, 0
+	for _, path := range paths {
+		err := datastore.ScanSegment(path, func(r datastore.Record) error {
+			if r.Err != nil {
+				corrupted++
+				fmt.Printf("%s: offset %d: %s\n", filepath.Base(path), r.Offset, r.Err)
+			} else {
+				records++
+			}
+			return nil
+		}, opts...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if corrupted > 0 {
+		fmt.Printf("%d corrupted of %d records in %d segments\n", corrupted, corrupted+records, len(paths))
+		return errCorrupted{}
+	}
+	fmt.Printf("ok: %d records in %d segments\n", records, len(paths))
+	return nil
+}
+
+func repair(args []string) error {
+	fs, dir, options := newFlagSet("repair")
+	segment := fs.String("segment", "", "file name of the segment to repair, all corrupted segments by default")
+	fs.Parse(args)
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	if *segment != "" {
+		paths = []string{filepath.Join(*dir, *segment)}
+	} else {
+		segments, err := datastore.ListSegments(*dir, opts...)
+		if err != nil {
+			return err
+		}
+		for _, s := range segments {
+			if s.Listed && s.Corrupted > 0 {
+				paths = append(paths, s.Path)
+			}
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range paths {
+		report, err := datastore.RepairSegment(path, opts...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		enc.Encode(RepairBody{
+			Segment:          filepath.Base(path),
+			Kept:             report.Kept,
+			Quarantined:      report.Quarantined,
+			QuarantinedBytes: report.QuarantinedBytes,
+			QuarantinePath:   report.QuarantinePath,
+		})
+	}
+	return nil
+}
+
+func compact(args []string) error {
+	fs, dir, options := newFlagSet("compact")
+	fs.Parse(args)
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	opts = append(opts,
+		datastore.WithCompactionInterval(0),
+		datastore.WithExpirySweepInterval(0),
+		datastore.WithLogger(log.Default()),
+	)
+	db, err := datastore.Open(*dir, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stats, err := db.Compact(context.Background())
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(CompactionStatsBody{
+		DurationMs:   stats.Duration.Milliseconds(),
+		Segments:     stats.Segments,
+		BytesRead:    stats.BytesRead,
+		BytesWritten: stats.BytesWritten,
+		KeysDropped:  stats.KeysDropped,
+	})
+}
+
+// segmentPaths returns the path of the named segment or of all segment files
+// of dir.
+func segmentPaths(dir, segment string, opts []datastore.Option) ([]string, error) {
+	if segment != "" {
+		return []string{filepath.Join(dir, segment)}, nil
+	}
+	segments, err := datastore.ListSegments(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(segments))
+	for i, s := range segments {
+		paths[i] = s.Path
+	}
+	return paths, nil
+}
@@ -0,0 +1,228 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A batch is stored as a header record of kindBatch, whose value holds the
+// number of records in the batch, immediately followed by those records. The
+// whole group is written with a single write to one segment and is applied on
+// recovery only if every record of it is intact.
+
+var (
+	ErrBatchTooLarge = errors.New("batch does not fit into a segment")
+	errBadBatch      = errors.New("batch is malformed")
+)
+
+// Batch collects writes that Db.Write applies atomically.
+type Batch struct {
+	entries []entry
+}
+
+// Put adds a string value to the batch.
+func (b *Batch) Put(key, value string) {
+	b.entries = append(b.entries, entry{
+		key:   key,
+		value: value,
+	})
+}
+
+// PutInt64 adds an int64 value to the batch.
+func (b *Batch) PutInt64(key string, value int64) {
+	b.entries = append(b.entries, entry{
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+	})
+}
+
+// Delete adds removal of the key to the batch.
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{
+		key:  key,
+		kind: kindTombstone,
+	})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write applies all writes of the batch atomically: after a crash either all
+// of them or none are recovered, and readers never see a part of them. When a
+// key is written more than once, the last write wins.
+func (db *Db) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	entries := append([]entry(nil), b.entries...)
+	return db.runInPutRoutine(func() error {
+		return db.writeBatch(entries)
+	})
+}
+
+func batchHeader(count int) entry {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(count))
+	return entry{
+		value: string(value),
+		kind:  kindBatch,
+	}
+}
+
+// batchCount returns the number of records following a batch header.
+func (e *entry) batchCount() (int, error) {
+	if len(e.value) != 4 {
+		return 0, fmt.Errorf("bad batch header of %d bytes", len(e.value))
+	}
+	return int(binary.LittleEndian.Uint32([]byte(e.value))), nil
+}
+
+// writeBatch appends the batch as one record group to the active segment and
+// publishes all its keys to the index at once.
+func (db *Db) writeBatch(entries []entry) error {
+	for i := range entries {
+		if err := db.opts.checkSize(&entries[i]); err != nil {
+			return fmt.Errorf("batch write %d: %w", i, err)
+		}
+		if err := db.opts.compress(&entries[i]); err != nil {
+			return err
+		}
+	}
+	segment := db.getLastSegment()
+	// Sequence numbers are only taken by a batch that is written.
+	if size := batchSize(entries, segment); size > db.opts.segmentSize {
+		return fmt.Errorf("%w: %d bytes, segment size %d", ErrBatchTooLarge, size, db.opts.segmentSize)
+	}
+	for i := range entries {
+		entries[i].seq = db.seq.Add(1)
+	}
+	data, positions := encodeBatch(entries, segment)
+	size := int64(len(data))
+
+	if db.outOffset+size > db.opts.segmentSize {
+		if err := db.createSegment(); err != nil {
+			return err
+		}
+		// A legacy segment may use another checksum than the new one, and the
+		// encryption key may have changed.
+		previous := segment
+		segment = db.getLastSegment()
+		if segment.checksum != previous.checksum || segment.sealer != previous.sealer {
+			data, positions = encodeBatch(entries, segment)
+		}
+	}
+	n, err := db.out.Write(data)
+	if err != nil {
+		return err
+	}
+	for i := range positions {
+		positions[i].position += db.outOffset
+		segment.addRecordHint(&entries[i], positions[i].position, positions[i].record)
+		db.trackExpiry(&entries[i])
+		db.compression.add(&entries[i])
+		positions[i].record = nil
+	}
+	segment.setKeys(positions)
+	db.outOffset += int64(n)
+	return nil
+}
+
+// encodeBatch encodes the batch header and entries in the format of segment s
+// and returns the positions of the entries relative to the start of the group.
+func encodeBatch(entries []entry, s *Segment) ([]byte, []batchPosition) {
+	header := batchHeader(len(entries))
+	header.checksum = s.checksum
+	data := header.Encode()
+	positions := make([]batchPosition, len(entries))
+	for i := range entries {
+		entries[i].checksum = s.checksum
+		entries[i].sealer = s.sealer
+		record := entries[i].Encode()
+		positions[i] = batchPosition{
+			key:      entries[i].key,
+			position: int64(len(data)),
+			record:   record,
+		}
+		data = append(data, record...)
+	}
+	return data, positions
+}
+
+// batchSize returns the size encodeBatch produces for the entries in the
+// format of segment s once they have sequence numbers.
+func batchSize(entries []entry, s *Segment) int64 {
+	header := batchHeader(len(entries))
+	header.checksum = s.checksum
+	size := header.encodedSize()
+	for _, e := range entries {
+		e.checksum, e.sealer = s.checksum, s.sealer
+		size += e.encodedSize()
+		if e.seq == 0 {
+			size += seqSize
+		}
+	}
+	return size
+}
+
+type batchPosition struct {
+	key      string
+	position int64
+	record   []byte
+}
+
+// setKeys indexes all keys of a batch under a single lock.
+func (s *Segment) setKeys(batch []batchPosition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := s.index.(hashIndex)
+	for _, p := range batch {
+		index[p.key] = p.position
+	}
+	s.records += len(batch)
+}
+
+// readRecoveredGroup reads the next record, or a whole batch if the record is
+// a batch header, and returns the records to index with their offsets
+// relative to the start of the group together with the size of the group.
+func readRecoveredGroup(in *bufio.Reader, remaining int64, c Checksum) ([]entry, []int64, int64, error) {
+	e, size, err := readRecoveredEntry(in, remaining, c)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if e.kind != kindBatch {
+		return []entry{e}, []int64{0}, size, nil
+	}
+
+	count, err := e.batchCount()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: %s", errBadBatch, err)
+	}
+	if int64(count)*int64(headerSize+c.size()) > remaining-size {
+		return nil, nil, 0, errRecordTooLong
+	}
+	entries := make([]entry, 0, count)
+	offsets := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		e, n, err := readRecoveredEntry(in, remaining-size, c)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if e.kind == kindBatch {
+			return nil, nil, 0, fmt.Errorf("%w: nested batch header", errBadBatch)
+		}
+		entries = append(entries, e)
+		offsets = append(offsets, size)
+		size += n
+	}
+	return entries, offsets, size, nil
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key3", "value3")
+
+	var b Batch
+	b.Put("key1", "batch1")
+	b.PutInt64("key2", 2)
+	b.Delete("key3")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		if value, err := db.Get("key1"); err != nil || value != "batch1" {
+			t.Errorf("Bad value returned expected batch1, got %s (%v)", value, err)
+		}
+		if n, err := db.GetInt64("key2"); err != nil || n != 2 {
+			t.Errorf("Bad value returned expected 2, got %d (%v)", n, err)
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	t.Run("applied", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		var b Batch
+		for i := 0; i < 5; i++ {
+			b.Put("key4", "value4")
+		}
+		seq := db.seq.Load()
+		if err := db.Write(&b); !errors.Is(err, ErrBatchTooLarge) {
+			t.Errorf("Expected ErrBatchTooLarge, got %v", err)
+		}
+		if db.seq.Load() != seq {
+			t.Errorf("Expected sequence number %d after a rejected batch, got %d", seq, db.seq.Load())
+		}
+	})
+
+	t.Run("torn batch is discarded", func(t *testing.T) {
+		b.Reset()
+		b.Put("key1", "torn")
+		b.Put("key5", "torn")
+		if err := db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := m.paths[len(m.paths)-1]
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+
+		var report RecoveryReport
+		db, err := NewDb(dir, 200, WithRecoveryHandler(func(r RecoveryReport) {
+			report = r
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if report.TruncatedSegment != path || report.DiscardedBytes != 89 {
+			t.Errorf("Unexpected recovery report %+v", report)
+		}
+		check(t, db)
+		if _, err := db.Get("key5"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+// A Bloom filter of a sealed segment is stored next to it in a file holding
+//
+//	bits [words]u64 | segment size u64 | hash count u32 | words u32 | sha1 of everything before
+//
+// A filter that is missing, fails its checksum or does not match the size of
+// its segment is rebuilt from the index on startup. The filter of an encrypted
+// segment is sealed with the key of the segment.
+const (
+	bloomSuffix      = ".bloom"
+	bloomTrailerSize = 16 + sha1.Size
+	maxBloomHashes   = 30
+)
+
+var errBadBloom = errors.New("bloom filter file is invalid")
+
+// bloomFilter tells that a key is certainly not in a segment. It is never
+// changed once built.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+func bloomPath(segmentPath string) string {
+	return segmentPath + bloomSuffix
+}
+
+// newBloomFilter returns a filter of the keys of index with the false positive
+// rate p.
+func newBloomFilter(index Index, p float64) (*bloomFilter, error) {
+	n := math.Max(float64(index.Len()), 1)
+	m := math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2))
+	words := int(math.Ceil(m / 64))
+	hashes := uint32(math.Round(float64(words*64) / n * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > maxBloomHashes {
+		hashes = maxBloomHashes
+	}
+	f := &bloomFilter{bits: make([]uint64, words), hashes: hashes}
+	err := index.Range("", "", func(key string, _ int64) error {
+		f.add(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// locations derives the bit positions of key by double hashing a single FNV
+// hash, which is stable across runs as the filters are persisted.
+func (f *bloomFilter) locations(key string, fn func(bit uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(key string) {
+	f.locations(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports false if key is certainly not in the filter.
+func (f *bloomFilter) mayContain(key string) bool {
+	return f.locations(key, func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+func (f *bloomFilter) encode(segmentSize int64) []byte {
+	data := make([]byte, len(f.bits)*8+bloomTrailerSize-sha1.Size)
+	for i, word := range f.bits {
+		binary.LittleEndian.PutUint64(data[i*8:], word)
+	}
+	trailer := data[len(f.bits)*8:]
+	binary.LittleEndian.PutUint64(trailer, uint64(segmentSize))
+	binary.LittleEndian.PutUint32(trailer[8:], f.hashes)
+	binary.LittleEndian.PutUint32(trailer[12:], uint32(len(f.bits)))
+	sum := sha1.Sum(data)
+	return append(data, sum[:]...)
+}
+
+func decodeBloomFilter(data []byte, segmentSize int64) (*bloomFilter, error) {
+	if len(data) < bloomTrailerSize {
+		return nil, errBadBloom
+	}
+	body := data[:len(data)-sha1.Size]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, fmt.Errorf("%w: bad checksum", errBadBloom)
+	}
+	trailer := body[len(body)-(bloomTrailerSize-sha1.Size):]
+	size := int64(binary.LittleEndian.Uint64(trailer))
+	hashes := binary.LittleEndian.Uint32(trailer[8:])
+	words := int(binary.LittleEndian.Uint32(trailer[12:]))
+	if size != segmentSize {
+		return nil, fmt.Errorf("%w: segment has %d bytes, filter expects %d", errBadBloom, segmentSize, size)
+	}
+	if words == 0 || words*8 != len(body)-len(trailer) || hashes < 1 || hashes > maxBloomHashes {
+		return nil, fmt.Errorf("%w: bad size", errBadBloom)
+	}
+	f := &bloomFilter{bits: make([]uint64, words), hashes: hashes}
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(body[i*8:])
+	}
+	return f, nil
+}
+
+// buildBloom builds the filter of a segment that will not be written anymore,
+// stores it next to the segment and makes lookups use it.
+func (s *Segment) buildBloom(p float64, mode os.FileMode) error {
+	s.mu.RLock()
+	f, err := newBloomFilter(s.index, p)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	s.bloom.Store(f)
+	data := f.encode(s.outOffset)
+	if s.sealer != nil {
+		data = s.sealer.seal(data, nil)
+	}
+	// A lost or torn filter is rebuilt on startup, so unlike hints it is not
+	// flushed to disk.
+	path := bloomPath(s.filePath)
+	if err := os.WriteFile(path+tmpSuffix, data, mode); err != nil {
+		_ = os.Remove(path + tmpSuffix)
+		return err
+	}
+	return os.Rename(path+tmpSuffix, path)
+}
+
+// loadBloom reads the stored filter of a sealed segment.
+func (s *Segment) loadBloom() error {
+	data, err := os.ReadFile(bloomPath(s.filePath))
+	if err != nil {
+		return err
+	}
+	if s.sealer != nil {
+		if data, err = s.sealer.open(data, nil); err != nil {
+			return fmt.Errorf("%w: %s", errBadBloom, err)
+		}
+	}
+	f, err := decodeBloomFilter(data, s.outOffset)
+	if err != nil {
+		return err
+	}
+	s.bloom.Store(f)
+	return nil
+}
+
+// find returns the position of the key in the segment, consulting the Bloom
+// filter of the segment before its index. The active segment has no filter.
+func (s *Segment) find(key string, c *bloomCounters) (int64, bool, error) {
+	f := s.bloom.Load()
+	if f != nil && !f.mayContain(key) {
+		c.misses.Add(1)
+		return 0, false, nil
+	}
+	position, ok, err := s.lookup(key)
+	if f != nil && err == nil {
+		c.hits.Add(1)
+		if !ok {
+			c.falsePositives.Add(1)
+		}
+	}
+	return position, ok, err
+}
+
+// sealBloom builds the filter of a segment that was just sealed.
+func (db *Db) sealBloom(s *Segment) {
+	if db.opts.bloomFalsePositiveRate == 0 {
+		return
+	}
+	if err := s.buildBloom(db.opts.bloomFalsePositiveRate, db.opts.fileMode); err != nil {
+		db.opts.logger.Printf("datastore: cannot write bloom filter for %s: %s", s.filePath, err)
+	}
+}
+
+// BloomStats counts how the Bloom filters of sealed segments answered key
+// lookups since the Db was opened.
+type BloomStats struct {
+	// Misses counts segments skipped because their filter ruled the key out.
+	Misses int64
+	// Hits counts segments whose filter let the key through, FalsePositives
+	// those of them whose index did not have the key.
+	Hits           int64
+	FalsePositives int64
+}
+
+// FalsePositiveRate returns the share of lookups of absent keys that the
+// filters let through, zero if there were none.
+func (s BloomStats) FalsePositiveRate() float64 {
+	if s.Misses+s.FalsePositives == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.Misses+s.FalsePositives)
+}
+
+type bloomCounters struct {
+	hits, misses, falsePositives atomic.Int64
+}
+
+// BloomStats reports how often Bloom filters saved probing segment indexes.
+func (db *Db) BloomStats() BloomStats {
+	c := &db.bloomStats
+	return BloomStats{
+		Misses:         c.misses.Load(),
+		Hits:           c.hits.Load(),
+		FalsePositives: c.falsePositives.Load(),
+	}
+}
@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	index := make(hashIndex)
+	for i := 0; i < 1000; i++ {
+		index[fmt.Sprintf("key%d", i)] = int64(i)
+	}
+	f, err := newBloomFilter(index, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range index {
+		if !f.mayContain(key) {
+			t.Fatalf("False negative for %s", key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.02 {
+		t.Errorf("Expected a false positive rate near 0.01, got %g", rate)
+	}
+
+	decoded, err := decodeBloomFilter(f.encode(4096), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range index {
+		if !decoded.mayContain(key) {
+			t.Fatalf("False negative for %s after decoding", key)
+		}
+	}
+	if _, err := decodeBloomFilter(f.encode(4096), 4097); !errors.Is(err, errBadBloom) {
+		t.Errorf("Expected errBadBloom for another segment size, got %v", err)
+	}
+	data := f.encode(4096)
+	data[0] ^= 1
+	if _, err := decodeBloomFilter(data, 4096); !errors.Is(err, errBadBloom) {
+		t.Errorf("Expected errBadBloom for a corrupted filter, got %v", err)
+	}
+}
+
+func TestDb_BloomFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(opts ...Option) (*Db, RecoveryReport) {
+		t.Helper()
+		var report RecoveryReport
+		opts = append([]Option{
+			WithCompactionInterval(0),
+			WithCompactionThreshold(100),
+			WithRecoveryHandler(func(r RecoveryReport) { report = r }),
+		}, opts...)
+		db, err := NewDb(dir, 300, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, report
+	}
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for i := 0; i < 30; i++ {
+			if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value of key%d returned (%v)", i, err)
+			}
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+
+	t.Run("sealed segments are filtered", func(t *testing.T) {
+		db, _ := open()
+		defer db.Close()
+		for i := 0; i < 30; i++ {
+			db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+		// Lookups use the in-memory indexes until the filters are stored.
+		check(t, db)
+		waitSealed(t, db)
+		segments := db.getSegments()
+		if len(segments) < 3 {
+			t.Fatalf("Expected at least 3 segments, got %d", len(segments))
+		}
+		for _, s := range segments[:len(segments)-1] {
+			if s.bloom.Load() == nil {
+				t.Errorf("Expected a bloom filter for %s", s.filePath)
+			}
+			if _, err := os.Stat(bloomPath(s.filePath)); err != nil {
+				t.Errorf("Expected a bloom filter file: %s", err)
+			}
+		}
+		if segments[len(segments)-1].bloom.Load() != nil {
+			t.Error("Expected no bloom filter for the active segment")
+		}
+
+		check(t, db)
+		stats := db.BloomStats()
+		if stats.Misses < int64(len(segments)-1) || stats.Hits < 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.FalsePositiveRate() > 0.5 {
+			t.Errorf("Unexpected false positive rate %g", stats.FalsePositiveRate())
+		}
+	})
+
+	t.Run("filters are rebuilt on recovery", func(t *testing.T) {
+		paths, _, err := findSegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(bloomPath(paths[0])); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(bloomPath(paths[1]), []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, report := open()
+		defer db.Close()
+		if report.RebuiltBloomFilters != 2 {
+			t.Errorf("Expected 2 rebuilt filters, got %d", report.RebuiltBloomFilters)
+		}
+		if _, err := os.Stat(bloomPath(paths[0])); err != nil {
+			t.Errorf("Expected the missing filter to be written again: %s", err)
+		}
+		check(t, db)
+	})
+
+	t.Run("filters loaded on recovery", func(t *testing.T) {
+		db, report := open()
+		defer db.Close()
+		if report.RebuiltBloomFilters != 0 {
+			t.Errorf("Expected no rebuilt filters, got %d", report.RebuiltBloomFilters)
+		}
+		check(t, db)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, report := open(WithBloomFilter(0))
+		defer db.Close()
+		if report.RebuiltBloomFilters != 0 {
+			t.Errorf("Expected no rebuilt filters, got %d", report.RebuiltBloomFilters)
+		}
+		check(t, db)
+		if stats := db.BloomStats(); stats != (BloomStats{}) {
+			t.Errorf("Expected no filter lookups, got %+v", stats)
+		}
+	})
+}
+
+// failingKeys is a KeyProvider that fails to return keys while fail is set.
+type failingKeys struct {
+	*KeyRing
+	fail atomic.Bool
+}
+
+func (k *failingKeys) Key(id uint32) ([]byte, error) {
+	if k.fail.Load() {
+		return nil, errors.New("key provider is down")
+	}
+	return k.KeyRing.Key(id)
+}
+
+// waitSealed waits until the filters and the indexes of all sealed segments
+// of db are stored.
+func waitSealed(t *testing.T, db *Db) {
+	t.Helper()
+	for _, s := range db.getSegments() {
+		if err := s.waitSealed(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDb_BloomFiltersRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ring, _ := ParseKeyRing("1:000102030405060708090a0b0c0d0e0f")
+	keys := &failingKeys{KeyRing: ring}
+	db, err := NewDb(dir, 1000, WithCompactionInterval(0), WithEncryption(keys), WithBloomFilter(0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	keys.fail.Store(true)
+	if _, err := db.Compact(context.Background()); err == nil {
+		t.Fatal("Expected compaction to fail without keys")
+	}
+	keys.fail.Store(false)
+	if segments := db.getSegments(); len(segments) != 1 || segments[0].bloom.Load() != nil {
+		t.Errorf("Expected a single active segment without a filter, got %d segments", len(segments))
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Bad value of %s returned (%v)", key, err)
+		}
+	}
+}
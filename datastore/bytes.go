@@ -0,0 +1,257 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// PutBytes stores a binary value. The value is copied, so the caller may reuse
+// the slice once PutBytes returns.
+func (db *Db) PutBytes(key string, value []byte) error {
+	return db.put(entry{
+		key:       key,
+		value:     string(value),
+		valueType: TypeBytes,
+	})
+}
+
+// GetBytes returns a value stored with PutBytes. The value is read from the
+// segment file straight into the returned slice.
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	value, _, err := db.GetBytesWithVersion(key)
+	return value, err
+}
+
+// GetBytesWithVersion returns a binary value together with its version.
+func (db *Db) GetBytesWithVersion(key string) ([]byte, uint64, error) {
+	r, err := db.GetReader(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readBytes(key, r)
+}
+
+// CompareAndSwapBytes is CompareAndSwap for binary values.
+func (db *Db) CompareAndSwapBytes(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return db.compareAndSwap(entry{
+		key:       key,
+		value:     string(value),
+		valueType: TypeBytes,
+	}, expectedVersion)
+}
+
+// PutBytes adds a binary value to the batch.
+func (b *Batch) PutBytes(key string, value []byte) {
+	b.entries = append(b.entries, entry{
+		key:       key,
+		value:     string(value),
+		valueType: TypeBytes,
+	})
+}
+
+// GetReader opens the value of the key for streaming, so that large values do
+// not have to be held in memory. The value may be of any type, the reader
+// reports it with Type. The checksum of the record is verified once the value
+// is read to the end. The reader must be closed.
+func (db *Db) GetReader(key string) (*ValueReader, error) {
+	keyPos, err := db.getPos(key)
+	if err != nil {
+		return nil, err
+	}
+	if keyPos == nil {
+		return nil, ErrNotFound
+	}
+	r, err := keyPos.segment.openValue(keyPos.position, db.now())
+	for err != nil && err != ErrNotFound && keyPos.segment.obsolete.Load() {
+		// The segment was merged and removed by compaction after the lookup.
+		if keyPos, err = db.getPos(key); err != nil {
+			return nil, err
+		}
+		if keyPos == nil {
+			return nil, ErrNotFound
+		}
+		r, err = keyPos.segment.openValue(keyPos.position, db.now())
+	}
+	return r, err
+}
+
+// ValueReader streams the value of a single record. Compressed values are
+// decompressed on the fly.
+type ValueReader struct {
+	file *segmentFile
+	in   *bufio.Reader
+	// stored reads the bytes of the value as stored in the file adding them to
+	// hash. value is the same reader or a decompressor on top of it.
+	stored       io.Reader
+	value        io.Reader
+	decompressor io.Closer
+	hash         hash.Hash
+	sumSize      int
+	size         int64
+	valueType    ValueType
+	version      uint64
+	verified     bool
+}
+
+// openValue opens the record at position and positions the reader at the
+// start of its value. Tombstones and records expired before now are reported
+// as ErrNotFound. Records of encrypted segments can only be verified as a
+// whole, so their values are read into memory.
+func (s *Segment) openValue(position int64, now time.Time) (*ValueReader, error) {
+	if s.sealer != nil {
+		e, err := s.getFromSegment(position)
+		if err != nil {
+			return nil, err
+		}
+		if e.isTombstone() || e.isExpired(now) {
+			return nil, ErrNotFound
+		}
+		return &ValueReader{
+			value:     strings.NewReader(e.value),
+			size:      int64(len(e.value)),
+			valueType: e.valueType,
+			version:   e.version(),
+			verified:  true,
+		}, nil
+	}
+	file, err := s.acquireFile()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newValueReader(file, position, s.checksum, now)
+	if err != nil {
+		file.release()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newValueReader(file *segmentFile, position int64, c Checksum, now time.Time) (*ValueReader, error) {
+	in := bufio.NewReader(file.section(position))
+	header, err := in.Peek(headerSize)
+	if err != nil {
+		return nil, err
+	}
+	size := recordSize(header, c)
+	vl := int64(binary.LittleEndian.Uint32(header[8:]))
+
+	prefix := make([]byte, size-vl-int64(c.size()))
+	if _, err := io.ReadFull(in, prefix); err != nil {
+		return nil, err
+	}
+	var e entry
+	e.decodePrefix(prefix)
+	if e.isTombstone() || e.isExpired(now) {
+		return nil, ErrNotFound
+	}
+
+	h := c.newHash()
+	h.Write(prefix)
+	stored := io.TeeReader(io.LimitReader(in, vl), h)
+	r := &ValueReader{
+		file:      file,
+		in:        in,
+		stored:    stored,
+		value:     stored,
+		hash:      h,
+		sumSize:   c.size(),
+		size:      vl,
+		valueType: e.valueType,
+		version:   e.version(),
+	}
+	if recordFlags(prefix)&flagCompressed != 0 {
+		dr, size, err := decompressReader(stored)
+		if err != nil {
+			return nil, err
+		}
+		r.value, r.decompressor, r.size = dr, dr, size
+	}
+	return r, nil
+}
+
+// Read reads the value. Once the value is exhausted it returns io.EOF, or
+// errBadChecksum if the record is corrupted. A compressed value that cannot
+// be decompressed is reported as errBadChecksum too when the record is
+// corrupted.
+func (r *ValueReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	if err != nil && !r.verified {
+		if verifyErr := r.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (r *ValueReader) verify() error {
+	// A decompressor may stop before the end of the stored bytes.
+	if _, err := io.Copy(io.Discard, r.stored); err != nil {
+		return err
+	}
+	sum := make([]byte, r.sumSize)
+	if _, err := io.ReadFull(r.in, sum); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, r.hash.Sum(nil)) {
+		return errBadChecksum
+	}
+	r.verified = true
+	return nil
+}
+
+// Size returns the length of the value in bytes.
+func (r *ValueReader) Size() int64 {
+	return r.size
+}
+
+// Type returns the type the value was stored with.
+func (r *ValueReader) Type() ValueType {
+	return r.valueType
+}
+
+// Version returns the version of the value.
+func (r *ValueReader) Version() uint64 {
+	return r.version
+}
+
+// Close releases the segment file.
+func (r *ValueReader) Close() error {
+	if r.decompressor != nil {
+		r.decompressor.Close()
+	}
+	if r.file != nil {
+		r.file.release()
+		r.file = nil
+	}
+	return nil
+}
+
+// readBytes reads a whole binary value from r and closes it.
+func readBytes(key string, r *ValueReader) ([]byte, uint64, error) {
+	defer r.Close()
+	if r.Type() != TypeBytes {
+		return nil, 0, &TypeMismatchError{Key: key, Expected: TypeBytes, Actual: r.Type()}
+	}
+	// The size comes from the record header, which is only verified once the
+	// value is read, so it merely caps the initial allocation.
+	var value bytes.Buffer
+	if size := r.Size(); size <= bufSize {
+		value.Grow(int(size))
+	} else {
+		value.Grow(bufSize)
+	}
+	if _, err := value.ReadFrom(r); err != nil {
+		return nil, 0, err
+	}
+	if int64(value.Len()) != r.Size() {
+		return nil, 0, errBadChecksum
+	}
+	return value.Bytes(), r.Version(), nil
+}
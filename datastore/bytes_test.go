@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_PutBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<22, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	blob := []byte{0, 1, 2, 0xff, 0xfe, 0, 'x'}
+	large := bytes.Repeat([]byte{0, 0x80, 'a', 0xff}, 1<<18)
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.PutBytes("blob", blob); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.GetBytes("blob")
+		if err != nil || !bytes.Equal(value, blob) {
+			t.Errorf("Bad value returned expected %v, got %v (%v)", blob, value, err)
+		}
+		db.Put("text", "value")
+
+		var mismatch *TypeMismatchError
+		if _, err := db.Get("blob"); !errors.As(err, &mismatch) || mismatch.Actual != TypeBytes {
+			t.Errorf("Expected TypeMismatchError, got %v", err)
+		}
+		if _, err := db.GetBytes("text"); !errors.As(err, &mismatch) || mismatch.Expected != TypeBytes {
+			t.Errorf("Expected TypeMismatchError, got %v", err)
+		}
+		if _, err := db.GetBytes("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		if err := db.PutBytes("large", large); err != nil {
+			t.Fatal(err)
+		}
+		r, err := db.GetReader("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if r.Size() != int64(len(large)) || r.Type() != TypeBytes || r.Version() == 0 {
+			t.Errorf("Unexpected reader of size %d, type %s, version %d", r.Size(), r.Type(), r.Version())
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), large) {
+			t.Error("Streamed value differs from the stored one")
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		it := db.Scan("blob", "", 0)
+		defer it.Close()
+		if !it.Next() || it.Type() != TypeBytes || !bytes.Equal(it.Value().([]byte), blob) {
+			t.Errorf("Unexpected scan result %v (%v)", it.Value(), it.Err())
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Release()
+		db.PutBytes("blob", []byte("changed"))
+		if value, err := snapshot.GetBytes("blob"); err != nil || !bytes.Equal(value, blob) {
+			t.Errorf("Bad value returned expected %v, got %v (%v)", blob, value, err)
+		}
+	})
+
+	t.Run("corrupted size", func(t *testing.T) {
+		db.PutBytes("sized", blob)
+		pos, err := db.getPos("sized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(pos.segment.filePath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, pos.position+8)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.GetBytes("sized"); err == nil {
+			t.Errorf("Expected an error for a corrupted value size, got %d bytes", len(value))
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := bytes.Index(data, large[:16]) + len(large)/2
+		_, err = f.WriteAt([]byte{^data[offset]}, int64(offset))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetBytes("large"); err != errBadChecksum {
+			t.Errorf("Expected errBadChecksum, got %v", err)
+		}
+	})
+}
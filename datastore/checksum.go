@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// Checksum identifies the algorithm that protects the records of a segment.
+type Checksum byte
+
+const (
+	// ChecksumSHA1 is used by segments written before the segment header was
+	// introduced.
+	ChecksumSHA1 Checksum = iota
+	// ChecksumCRC32C is the default for new segments. It is much cheaper to
+	// compute than SHA1 and is enough to detect torn and corrupted records.
+	ChecksumCRC32C
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumSHA1:
+		return "sha1"
+	case ChecksumCRC32C:
+		return "crc32c"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+func (c Checksum) valid() bool {
+	return c == ChecksumSHA1 || c == ChecksumCRC32C
+}
+
+// size returns the number of bytes of a checksum.
+func (c Checksum) size() int {
+	if c == ChecksumCRC32C {
+		return crc32.Size
+	}
+	return sha1.Size
+}
+
+func (c Checksum) newHash() hash.Hash {
+	if c == ChecksumCRC32C {
+		return crc32.New(castagnoli)
+	}
+	return sha1.New()
+}
+
+// sum returns the checksum of data.
+func (c Checksum) sum(data []byte) []byte {
+	h := c.newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
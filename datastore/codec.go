@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// A compressed record has flagCompressed set and its value starts with the ID
+// of the codec and the u32 length of the uncompressed value followed by the
+// compressed bytes. The checksum covers the stored bytes, so corruption is
+// detected before anything is decompressed.
+const compressedPrefixSize = 5
+
+var errUnknownCodec = errors.New("value is compressed with an unknown codec")
+
+// Codec compresses values of records. Its ID is stored in every record it
+// compressed, so it must stay the same for as long as such records exist.
+type Codec interface {
+	// ID identifies the codec in records, zero is reserved.
+	ID() byte
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// FlateCodec compresses values with DEFLATE. It is always registered.
+var FlateCodec Codec = flateCodec{}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return 1
+}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{FlateCodec.ID(): FlateCodec}
+)
+
+// RegisterCodec makes a codec available for reading and writing values. It
+// panics if the ID is zero or already taken by another codec.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() == 0 {
+		panic("datastore: codec ID 0 is reserved")
+	}
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("datastore: codec ID %d is registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+func lookupCodec(id byte) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", errUnknownCodec, id)
+	}
+	return c, nil
+}
+
+// compress returns the stored form of value, or false if compressing does not
+// make it smaller.
+func compress(c Codec, value string) (string, bool, error) {
+	var buf bytes.Buffer
+	buf.Grow(compressedPrefixSize + len(value)/2)
+	prefix := make([]byte, compressedPrefixSize)
+	prefix[0] = c.ID()
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(len(value)))
+	buf.Write(prefix)
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", false, err
+	}
+	if err := w.Close(); err != nil {
+		return "", false, err
+	}
+	if buf.Len() >= len(value) {
+		return "", false, nil
+	}
+	return buf.String(), true, nil
+}
+
+// decompressReader returns a reader of the uncompressed value stored in r and
+// its length. It reads the prefix of the value from r.
+func decompressReader(r io.Reader) (io.ReadCloser, int64, error) {
+	prefix := make([]byte, compressedPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, 0, err
+	}
+	c, err := lookupCodec(prefix[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	dr, err := c.NewReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dr, int64(binary.LittleEndian.Uint32(prefix[1:])), nil
+}
+
+// decompress returns the uncompressed value of a compressed record.
+func decompress(stored string) (string, error) {
+	dr, size, err := decompressReader(bytes.NewReader([]byte(stored)))
+	if err != nil {
+		return "", err
+	}
+	defer dr.Close()
+	value := make([]byte, size)
+	if _, err := io.ReadFull(dr, value); err != nil {
+		return "", fmt.Errorf("cannot decompress value: %w", err)
+	}
+	return string(value), nil
+}
+
+// CompressionStats describes the values written since the Db was opened.
+// Records rewritten by compaction are not counted.
+type CompressionStats struct {
+	// Values counts written values, Compressed those stored compressed.
+	Values     int64
+	Compressed int64
+	// RawBytes is the total length of the values and StoredBytes the space
+	// they take in segment files.
+	RawBytes    int64
+	StoredBytes int64
+}
+
+// Ratio returns RawBytes divided by StoredBytes, 1 if nothing was written.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+type compressionCounters struct {
+	values, compressed, rawBytes, storedBytes atomic.Int64
+}
+
+func (c *compressionCounters) add(e *entry) {
+	if e.kind != kindValue {
+		return
+	}
+	c.values.Add(1)
+	c.rawBytes.Add(int64(len(e.value)))
+	if e.stored != "" {
+		c.compressed.Add(1)
+		c.storedBytes.Add(int64(len(e.stored)))
+	} else {
+		c.storedBytes.Add(int64(len(e.value)))
+	}
+}
+
+// CompressionStats reports how well values written since Open compressed.
+func (db *Db) CompressionStats() CompressionStats {
+	c := &db.compression
+	return CompressionStats{
+		Values:      c.values.Load(),
+		Compressed:  c.compressed.Load(),
+		RawBytes:    c.rawBytes.Load(),
+		StoredBytes: c.storedBytes.Load(),
+	}
+}
@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type gzipCodec struct {
+	id byte
+}
+
+func (c gzipCodec) ID() byte {
+	return c.id
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func init() {
+	RegisterCodec(gzipCodec{id: 2})
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	doc := `{"items": [` + strings.Repeat(`{"name": "item", "tags": ["a", "b"]}, `, 100) + `{}]}`
+	blob := bytes.Repeat([]byte{0, 1, 2, 3}, 1000)
+	open := func(opts ...Option) *Db {
+		t.Helper()
+		db, err := NewDb(dir, 1<<20, append([]Option{WithCompactionInterval(0)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for key, want := range map[string]string{"doc": doc, "small": "value", "plain": doc} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value of %s returned (%v)", key, err)
+			}
+		}
+		if value, err := db.GetBytes("blob"); err != nil || !bytes.Equal(value, blob) {
+			t.Errorf("Bad binary value returned (%v)", err)
+		}
+		if value, err := db.GetBytes("gzip"); err != nil || !bytes.Equal(value, blob) {
+			t.Errorf("Bad gzip value returned (%v)", err)
+		}
+	}
+
+	t.Run("compressed writes", func(t *testing.T) {
+		db := open(WithCompression(FlateCodec, 100))
+		defer db.Close()
+		db.Put("doc", doc)
+		db.Put("small", "value")
+		db.PutBytes("blob", blob)
+		b := new(Batch)
+		b.Put("plain", doc)
+		db.Write(b)
+		r, err := db.GetReader("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if r.Size() != int64(len(blob)) {
+			t.Errorf("Expected size %d, got %d", len(blob), r.Size())
+		}
+		if value, err := io.ReadAll(r); err != nil || !bytes.Equal(value, blob) {
+			t.Errorf("Bad streamed value returned (%v)", err)
+		}
+
+		stats := db.CompressionStats()
+		if stats.Values != 4 || stats.Compressed != 3 || stats.RawBytes != int64(2*len(doc)+len(blob)+len("value")) {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.Ratio() < 5 {
+			t.Errorf("Expected a compression ratio above 5, got %g", stats.Ratio())
+		}
+	})
+
+	t.Run("mixed records", func(t *testing.T) {
+		db := open(WithCompression(gzipCodec{id: 2}, 100))
+		db.PutBytes("gzip", blob)
+		db.Close()
+
+		db = open()
+		defer db.Close()
+		db.Put("plain", doc)
+		check(t, db)
+		if stats := db.CompressionStats(); stats.Compressed != 0 || stats.Ratio() != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("compaction compresses", func(t *testing.T) {
+		db := open(WithCompression(FlateCodec, 100))
+		defer db.Close()
+		if err := db.runInPutRoutine(db.rotate); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		compressed := make(map[string]bool)
+		err := ScanSegment(db.getSegments()[0].filePath, func(r Record) error {
+			compressed[r.Key] = r.Compressed
+			return r.Err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compressed["plain"] || !compressed["gzip"] || compressed["small"] {
+			t.Errorf("Unexpected compressed records %v", compressed)
+		}
+		check(t, db)
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		db := open()
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		db := open(WithCompression(FlateCodec, 100))
+		defer db.Close()
+		db.Put("doc", doc)
+		keyPos, err := db.getPos("doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		position := keyPos.position
+		f, err := os.OpenFile(db.getLastSegment().filePath, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff, 0xff, 0xff}, position+headerSize+seqSize+int64(len("doc"))+compressedPrefixSize+10)
+		f.Close()
+		if _, err := db.Get("doc"); !errors.Is(err, errBadChecksum) {
+			t.Errorf("Expected errBadChecksum, got %v", err)
+		}
+		r, err := db.GetReader("doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := io.ReadAll(r); !errors.Is(err, errBadChecksum) {
+			t.Errorf("Expected errBadChecksum from the reader, got %v", err)
+		}
+	})
+}
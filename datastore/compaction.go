@@ -0,0 +1,421 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// CompactionStats describes a finished compaction.
+type CompactionStats struct {
+	Started  time.Time
+	Duration time.Duration
+	// Segments is the number of segments merged into one.
+	Segments     int
+	BytesRead    int64
+	BytesWritten int64
+	// KeysDropped counts deleted and expired keys whose records were removed.
+	KeysDropped int
+}
+
+// CompactionStatus is a snapshot of the compaction state of a Db.
+type CompactionStatus struct {
+	Running      bool
+	GarbageRatio float64
+	// Last holds the result of the latest successful compaction, if any.
+	Last *CompactionStats
+}
+
+// Compact seals the active segment and merges all segments into one. It waits
+// for a running background compaction to finish first. Cancelling ctx stops
+// the wait or aborts the merge and leaves the segments untouched. After Close
+// it fails with ErrClosed.
+func (db *Db) Compact(ctx context.Context) (CompactionStats, error) {
+	if !db.tryLockCompaction() {
+		select {
+		case db.compactSem <- struct{}{}:
+		case <-ctx.Done():
+			return CompactionStats{}, ctx.Err()
+		case <-db.done:
+			return CompactionStats{}, ErrClosed
+		}
+	}
+	defer db.unlockCompaction()
+	if !db.addCompaction() {
+		return CompactionStats{}, ErrClosed
+	}
+	defer db.compactions.Done()
+
+	if err := db.runInPutRoutine(db.rotate); err != nil {
+		return CompactionStats{}, err
+	}
+	return db.compact(ctx)
+}
+
+// CompactionStatus reports whether a compaction is running, the current
+// garbage estimate and the result of the last compaction.
+func (db *Db) CompactionStatus() CompactionStatus {
+	return CompactionStatus{
+		Running:      db.compacting.Load(),
+		GarbageRatio: db.GarbageRatio(),
+		Last:         db.lastCompaction.Load(),
+	}
+}
+
+// garbageEstimate is the garbage ratio computed for a list of sealed
+// segments, which only changes when a segment is sealed or compacted.
+type garbageEstimate struct {
+	first, last *Segment
+	segments    int
+	ratio       float64
+}
+
+// GarbageRatio estimates the share of records in sealed segments that are
+// shadowed by newer records of the same key in sealed segments and would be
+// dropped by compaction. Deleted keys are not accounted for.
+func (db *Db) GarbageRatio() float64 {
+	segments := db.getSegments()
+	sealed := segments[:len(segments)-1]
+	if len(sealed) == 0 {
+		return 0
+	}
+	g := db.garbage.Load()
+	if g != nil && g.first == sealed[0] && g.last == sealed[len(sealed)-1] && g.segments == len(sealed) {
+		return g.ratio
+	}
+
+	total := 0
+	indexes := make([]Index, len(sealed))
+	for i, s := range sealed {
+		s.mu.RLock()
+		total += s.records
+		indexes[i] = s.index
+		s.mu.RUnlock()
+	}
+	if total == 0 {
+		return 0
+	}
+	keys, err := db.countKeys(indexes)
+	if err != nil {
+		db.opts.logger.Printf("datastore: cannot estimate garbage: %s", err)
+		return 0
+	}
+	ratio := 1 - float64(keys)/float64(total)
+	db.garbage.Store(&garbageEstimate{first: sealed[0], last: sealed[len(sealed)-1], segments: len(sealed), ratio: ratio})
+	return ratio
+}
+
+// countKeys counts distinct keys of indexes. On-disk indexes are merged as
+// they are sorted, so that their keys are never all in memory.
+func (db *Db) countKeys(indexes []Index) (int, error) {
+	keys := 0
+	if db.opts.indexBlockSize > 0 {
+		err := mergeIndexes(indexes, func(string, int, int64) error {
+			keys++
+			return nil
+		})
+		return keys, err
+	}
+	seen := make(map[string]struct{})
+	for _, index := range indexes {
+		err := index.Range("", "", func(key string, _ int64) error {
+			seen[key] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(seen), nil
+}
+
+// startCompactionScheduler periodically compacts sealed segments once their
+// estimated garbage ratio exceeds the configured threshold.
+func (db *Db) startCompactionScheduler() {
+	if db.opts.compactionInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(db.opts.compactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.done:
+				return
+			case <-ticker.C:
+				if db.GarbageRatio() > db.opts.garbageRatio {
+					db.compactOldSegments()
+				}
+			}
+		}
+	}()
+}
+
+// compactOldSegments merges all sealed segments in background unless a
+// compaction is already running or the Db is closed.
+func (db *Db) compactOldSegments() {
+	if !db.tryLockCompaction() {
+		return
+	}
+	if !db.addCompaction() {
+		db.unlockCompaction()
+		return
+	}
+	go func() {
+		defer db.compactions.Done()
+		defer db.unlockCompaction()
+		if _, err := db.compact(context.Background()); err != nil {
+			db.opts.logger.Printf("datastore: compaction failed: %s", err)
+		}
+	}()
+}
+
+// addCompaction registers a compaction for Close to wait for, false once the
+// Db is closed.
+func (db *Db) addCompaction() bool {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	select {
+	case <-db.done:
+		return false
+	default:
+	}
+	db.compactions.Add(1)
+	return true
+}
+
+// tryLockCompaction takes the compaction token, false if a compaction is
+// already running.
+func (db *Db) tryLockCompaction() bool {
+	select {
+	case db.compactSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (db *Db) unlockCompaction() {
+	<-db.compactSem
+}
+
+// compact replaces all sealed segments with a single one that keeps only the
+// newest version of every key and drops deleted and expired keys. It must be
+// called with the compaction token taken.
+//
+// The merged segment is fully written and flushed under a temporary name before
+// it is renamed and recorded in the manifest, and the segment list is swapped
+// under db.mu. Superseded files are deleted only after that, so a crash at any
+// point leaves either the old or the new set of segments listed in the
+// manifest, and recovery removes whatever is not listed.
+func (db *Db) compact(ctx context.Context) (CompactionStats, error) {
+	stats := CompactionStats{Started: time.Now()}
+	db.compacting.Store(true)
+	defer db.compacting.Store(false)
+
+	db.mu.Lock()
+	current := db.getSegments()
+	sealed := current[:len(current)-1]
+	if len(sealed) == 0 {
+		db.mu.Unlock()
+		return stats, nil
+	}
+	filePath := db.getNewFileName()
+	db.mu.Unlock()
+	stats.Segments = len(sealed)
+	// A segment must not be removed while its filter and index are written.
+	for _, s := range sealed {
+		if err := s.waitSealed(ctx); err != nil {
+			return stats, err
+		}
+	}
+
+	merged, err := db.mergeSegments(ctx, sealed, filePath, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	db.mu.Lock()
+	segments := append([]*Segment{merged}, db.getSegments()[len(sealed):]...)
+	err = db.writeManifest(segments)
+	if err == nil {
+		db.setSegments(segments)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		_ = os.Remove(filePath)
+		_ = os.Remove(hintPath(filePath))
+		_ = os.Remove(indexPath(filePath))
+		return stats, err
+	}
+
+	for _, s := range sealed {
+		db.removeSegment(s)
+	}
+	if err := syncDir(db.dir); err != nil {
+		return stats, err
+	}
+
+	stats.Duration = time.Since(stats.Started)
+	db.lastCompaction.Store(&stats)
+	return stats, nil
+}
+
+// mergeSegments writes the live records of segments into a new segment file.
+// With WithDiskIndex the index of the new segment is written to disk as the
+// records are copied.
+func (db *Db) mergeSegments(ctx context.Context, segments []*Segment, filePath string, stats *CompactionStats) (*Segment, error) {
+	merged, header, err := db.opts.newSegment(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var iw *indexWriter
+	if db.opts.indexBlockSize > 0 {
+		if iw, err = newIndexWriter(merged, db.opts.indexBlockSize, db.opts.fileMode); err != nil {
+			return nil, err
+		}
+		defer iw.abort()
+	}
+	tmpPath := filePath + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, db.opts.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(header)
+	if err == nil && iw != nil {
+		err = writeMergedSorted(ctx, f, segments, merged, &db.opts, db.now(), stats, iw)
+	} else if err == nil {
+		err = writeMerged(ctx, f, segments, merged, &db.opts, db.now(), stats)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	if iw != nil {
+		index, err := iw.finish(merged.outOffset, merged.records)
+		if err != nil {
+			_ = os.Remove(filePath)
+			return nil, err
+		}
+		merged.index = index
+		merged.nextExpiry = earliestExpiry(iw.expiries)
+	} else {
+		merged.records = merged.index.Len()
+		expiries := merged.hintExpiries()
+		merged.nextExpiry = earliestExpiry(expiries)
+		if err := merged.writeHint(db.opts.fileMode); err != nil {
+			db.opts.logger.Printf("datastore: cannot write hint for %s: %s", filePath, err)
+			merged.expiries = expiries
+		}
+	}
+	merged.hints = nil
+	db.sealBloom(merged)
+	return merged, nil
+}
+
+// writeMerged copies the newest record of every key from segments to out and
+// indexes it in merged, dropping deleted keys and keys expired before now.
+// Values that are not compressed yet are compressed as configured by o.
+// Segments are visited newest first, so the first record seen for a key
+// shadows all older ones. The oldest segment always takes part in the merge,
+// so nothing older is left that a dropped record could resurrect.
+func writeMerged(ctx context.Context, out io.Writer, segments []*Segment, merged *Segment, o *options, now time.Time, stats *CompactionStats) error {
+	w := bufio.NewWriterSize(out, bufSize)
+	seen := make(map[string]struct{})
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		s.mu.RLock()
+		err := s.forEach(func(key string, position int64) error {
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			offset := merged.outOffset
+			e, record, err := copyRecord(w, s, position, merged, o, now, stats)
+			if e != nil {
+				merged.addRecordHint(e, offset, record)
+				merged.index.(hashIndex)[key] = offset
+			}
+			return err
+		})
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// writeMergedSorted works like writeMerged but visits keys in ascending order
+// merging the sorted indexes of segments, so that neither the keys seen nor
+// the index of merged are held in memory. The index is written by iw instead.
+func writeMergedSorted(ctx context.Context, out io.Writer, segments []*Segment, merged *Segment, o *options, now time.Time, stats *CompactionStats, iw *indexWriter) error {
+	w := bufio.NewWriterSize(out, bufSize)
+	indexes := make([]Index, len(segments))
+	for i, s := range segments {
+		indexes[i] = s.getIndex()
+	}
+	err := mergeIndexes(indexes, func(key string, newest int, position int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		offset := merged.outOffset
+		e, _, err := copyRecord(w, segments[newest], position, merged, o, now, stats)
+		if err != nil || e == nil {
+			return err
+		}
+		merged.records++
+		return iw.add(key, offset, e.expiresAt)
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// copyRecord appends the record at position of s to merged unless it is a
+// tombstone or has expired, in which case the returned entry is nil. Values
+// that are not compressed yet are compressed as configured by o.
+func copyRecord(w io.Writer, s *Segment, position int64, merged *Segment, o *options, now time.Time, stats *CompactionStats) (*entry, []byte, error) {
+	e, err := s.readRecordAt(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.BytesRead += e.encodedSize()
+	if e.isTombstone() || e.isExpired(now) {
+		stats.KeysDropped++
+		return nil, nil, nil
+	}
+	if err := o.compress(&e); err != nil {
+		return nil, nil, err
+	}
+	e.checksum = merged.checksum
+	e.sealer = merged.sealer
+	record := e.Encode()
+	n, err := w.Write(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged.outOffset += int64(n)
+	stats.BytesWritten += int64(n)
+	return &e, record, nil
+}
+
+// forEach calls fn for every indexed key until fn returns an error.
+func (s *Segment) forEach(fn func(key string, position int64) error) error {
+	return s.index.Range("", "", fn)
+}
@@ -0,0 +1,270 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDb_CompactionManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	db.Put("key2", "value5")
+	db.Put("key4", "value4")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("obsolete files are removed", func(t *testing.T) {
+		expected := []string{manifestFileName, outFileName + "2", outFileName + "3", outFileName + "3" + bloomSuffix, outFileName + "3" + hintSuffix}
+		if names := segmentFiles(t, dir); !reflect.DeepEqual(names, expected) {
+			t.Errorf("Expected files %v, got %v", expected, names)
+		}
+		m, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []string{filepath.Join(dir, outFileName+"3"), filepath.Join(dir, outFileName+"2")}
+		if !reflect.DeepEqual(m.paths, expected) {
+			t.Errorf("Expected manifest %v, got %v", expected, m.paths)
+		}
+	})
+
+	t.Run("unfinished compaction is ignored", func(t *testing.T) {
+		stale := entry{key: "key1", value: "stale"}
+		for _, name := range []string{outFileName + "7", outFileName + "8" + tmpSuffix} {
+			if err := os.WriteFile(filepath.Join(dir, name), stale.Encode(), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var report RecoveryReport
+		db, err := NewDb(dir, 85, WithRecoveryHandler(func(r RecoveryReport) {
+			report = r
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if len(report.RemovedFiles) != 2 {
+			t.Errorf("Expected 2 removed files, got %v", report.RemovedFiles)
+		}
+		for key, want := range map[string]string{"key1": "value1", "key2": "value5", "key4": "value4"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", want, value, err)
+			}
+		}
+		if db.lastSegmentIndex != 8 {
+			t.Errorf("Expected next segment index 8, got %d", db.lastSegmentIndex)
+		}
+	})
+}
+
+func TestDb_CompactionConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < 10; i++ {
+					value, err := db.Get(fmt.Sprintf("key%d", i))
+					if err != nil || value != fmt.Sprintf("value%d", i) {
+						t.Errorf("Bad value returned expected value%d, got %s (%v)", i, value, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for j := 0; j < 200; j++ {
+		if err := db.Put(fmt.Sprintf("other%d", j%7), "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key1", "value3")
+	db.Delete("key2")
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := db.Compact(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		if segments := db.getSegments(); len(segments) != 2 {
+			t.Errorf("Expected sealed and active segments, got %d", len(segments))
+		}
+		if status := db.CompactionStatus(); status.Last != nil || status.Running {
+			t.Errorf("Unexpected status %+v", status)
+		}
+	})
+
+	t.Run("waiting cancelled", func(t *testing.T) {
+		if !db.tryLockCompaction() {
+			t.Fatal("Expected no running compaction")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := db.Compact(ctx)
+		db.unlockCompaction()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("full merge", func(t *testing.T) {
+		stats, err := db.Compact(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Segments != 1 || stats.KeysDropped != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.BytesRead != 66 || stats.BytesWritten != 36 {
+			t.Errorf("Expected 66 bytes read and 36 written, got %+v", stats)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value3" {
+			t.Errorf("Bad value returned expected value3, got %s (%v)", value, err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		status := db.CompactionStatus()
+		if status.Last == nil || *status.Last != stats || status.GarbageRatio != 0 {
+			t.Errorf("Unexpected status %+v", status)
+		}
+	})
+
+	t.Run("nothing to merge", func(t *testing.T) {
+		stats, err := db.Compact(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Segments != 1 || stats.BytesWritten != 36 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("after close", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Compact(context.Background()); err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+		db.compactOldSegments()
+		if !db.tryLockCompaction() {
+			t.Error("Expected no compaction to start after Close")
+		}
+	})
+}
+
+func TestDb_ScheduledCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100,
+		WithCompactionThreshold(100),
+		WithCompactionInterval(10*time.Millisecond),
+		WithGarbageRatio(0.4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 6; i++ {
+		db.Put("key", fmt.Sprintf("value%d", i))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.CompactionStatus().Last == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Scheduled compaction did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ratio := db.GarbageRatio(); ratio != 0 {
+		t.Errorf("Expected no garbage after compaction, got %g", ratio)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value5" {
+		t.Errorf("Bad value returned expected value5, got %s (%v)", value, err)
+	}
+}
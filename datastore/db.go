@@ -1,30 +1,29 @@
 package datastore
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const outFileName = "current-data"
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashIndex map[string]int64
-
-type IndexOp struct {
-	isWrite bool
-	key     string
-	index   int64
-}
+// ErrClosed is returned by writes to a closed Db.
+var ErrClosed = fmt.Errorf("database is closed")
 
 type EntryWithChan struct {
-	e   entry
-	res chan error
+	e     entry
+	merge *mergeRequest
+	// control is run by the put goroutine instead of writing e, ordered with
+	// the writes around it.
+	control func() error
+	res     chan error
 }
 
 type KeyPosition struct {
@@ -37,301 +36,591 @@ type Db struct {
 	outPath          string
 	outOffset        int64
 	dir              string
-	segmentSize      int64
 	lastSegmentIndex int
-	indexOps         chan IndexOp
-	keyPositions     chan *KeyPosition
 	putOps           chan EntryWithChan
+	// seq is the last sequence number given to a record.
+	seq            atomic.Uint64
+	compacting     atomic.Bool
+	compactions    sync.WaitGroup
+	lastCompaction atomic.Pointer[CompactionStats]
+	compression    compressionCounters
+	bloomStats     bloomCounters
+	garbage        atomic.Pointer[garbageEstimate]
+	opts           options
+	now            func() time.Time
+	// syncFile flushes a segment file to disk.
+	syncFile func(*os.File) error
+	done     chan struct{}
+	// putStopped is closed once the put goroutine has returned.
+	putStopped chan struct{}
+	closeOnce  sync.Once
+	// closeMu orders closing done with registering compactions, so that
+	// Close waits for every compaction started before it.
+	closeMu sync.Mutex
+
+	// expiries holds expiry times of keys whose newest record is in the
+	// active segment and expires. It is owned by the put goroutine. Expiry
+	// times of sealed segments are kept in their hint or index files.
+	expiries map[string]int64
+
+	pinMu sync.Mutex
+
+	// compactSem holds a token while a compaction runs. Background
+	// compactions skip their run when it is taken, Compact waits for it.
+	compactSem chan struct{}
+
+	// mu serializes changes of segments and lastSegmentIndex made by both the
+	// put goroutine and compaction.
+	mu sync.Mutex
+	// segments is the list of segments, oldest first. It is never modified in
+	// place but replaced as a whole, so reads load it without locking.
+	segments atomic.Pointer[[]*Segment]
+}
 
-	segments []*Segment
+// NewDb opens the database in dir starting a new segment whenever the active
+// one grows beyond segmentSize bytes.
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
+	return Open(dir, append([]Option{WithSegmentSize(segmentSize)}, opts...)...)
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+// Open opens the database stored in dir, creating it if dir has no segments.
+func Open(dir string, opts ...Option) (*Db, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid datastore options: %w", err)
+	}
+
 	db := &Db{
-		segments:     make([]*Segment, 0),
-		dir:          dir,
-		segmentSize:  segmentSize,
-		indexOps:     make(chan IndexOp),
-		keyPositions: make(chan *KeyPosition),
-		putOps:       make(chan EntryWithChan),
+		dir:        dir,
+		putOps:     make(chan EntryWithChan),
+		opts:       o,
+		now:        time.Now,
+		syncFile:   (*os.File).Sync,
+		done:       make(chan struct{}),
+		putStopped: make(chan struct{}),
+		compactSem: make(chan struct{}, 1),
+		expiries:   make(map[string]int64),
 	}
+	db.setSegments(nil)
 
-	err := db.createSegment()
+	report, err := db.recover()
 	if err != nil {
 		return nil, err
 	}
-
-	err = db.recover()
-	if err != nil && err != io.EOF {
-		return nil, err
+	if report.DiscardedBytes > 0 {
+		o.logger.Printf("datastore: discarded %d bytes of a torn write at the end of %s", report.DiscardedBytes, report.TruncatedSegment)
+	}
+	if o.recoveryHandler != nil {
+		o.recoveryHandler(report)
 	}
 
-	db.startIndexRoutine()
 	db.startPutRoutine()
+	db.startCompactionScheduler()
+	db.startExpirySweeper()
 
 	return db, nil
 }
 
-func (db *Db) startIndexRoutine() {
-	go func() {
-		for {
-			op := <-db.indexOps
-			if op.isWrite {
-				db.setKey(op.key, op.index)
-			} else {
-				s, p, err := db.getSegmentAndPosition(op.key)
-				if err != nil {
-					db.keyPositions <- nil
-				} else {
-					db.keyPositions <- &KeyPosition{
-						s,
-						p,
-					}
-				}
-			}
-		}
-	}()
-}
-
 const bufSize = 8192
 
+// createSegment seals the active segment, starts a new active segment and
+// records it in the manifest. The filter and the index of the sealed segment
+// are stored in background by seal.
 func (db *Db) createSegment() error {
+	var sealed *Segment
+	if db.out != nil {
+		sealed = db.getLastSegment()
+	}
+
+	db.mu.Lock()
 	filePath := db.getNewFileName()
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+	newSegment, header, err := db.opts.newSegment(filePath)
 	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, db.opts.fileMode)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if _, err := f.Write(header); err != nil {
+		db.mu.Unlock()
+		_ = f.Close()
+		_ = os.Remove(filePath)
+		return err
+	}
+
+	current := db.getSegments()
+	segments := append(current[:len(current):len(current)], newSegment)
+	if err := db.writeManifest(segments); err != nil {
+		db.mu.Unlock()
+		_ = f.Close()
+		_ = os.Remove(filePath)
 		return err
 	}
+	// The filter and the index are stored only once the new segment is in
+	// place, a segment that stays active after a failure must keep taking
+	// writes into its in-memory index.
+	if sealed != nil {
+		sealed.outOffset = db.outOffset
+		sealed.expiries = db.expiries
+		sealed.nextExpiry = earliestExpiry(db.expiries)
+		sealed.sealing = make(chan struct{})
+	}
+	db.setSegments(segments)
+	db.mu.Unlock()
 
-	newSegment := &Segment{
-		filePath: filePath,
-		index:    make(hashIndex),
+	if db.out != nil {
+		if err := db.closeFile(db.out); err != nil {
+			db.opts.logger.Printf("datastore: cannot close sealed segment %s: %s", db.outPath, err)
+		}
+	}
+	if sealed != nil {
+		db.expiries = make(map[string]int64)
+		go db.seal(sealed)
 	}
 	db.out = f
-	db.outOffset = 0
+	db.outOffset = newSegment.start
 	db.outPath = filePath
-	db.segments = append(db.segments, newSegment)
-	if len(db.segments) >= 3 {
+	if len(segments) >= db.opts.compactionThreshold {
 		db.compactOldSegments()
 	}
-	return err
+	return nil
+}
+
+// seal stores the Bloom filter and the index of a segment sealed by
+// createSegment. It runs in its own goroutine, so that writes do not wait for
+// it, and lookups use the in-memory index of the segment until it is done.
+func (db *Db) seal(s *Segment) {
+	defer close(s.sealing)
+	db.sealBloom(s)
+	db.sealIndex(s, s.expiries)
+	s.hints = nil
+}
+
+// waitSealed waits until the filter and the index of a segment sealed by
+// createSegment are stored.
+func (s *Segment) waitSealed(ctx context.Context) error {
+	if s.sealing == nil {
+		return nil
+	}
+	select {
+	case <-s.sealing:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// getNewFileName allocates a name for a segment file. It must be called with
+// db.mu held.
 func (db *Db) getNewFileName() string {
 	result := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.lastSegmentIndex))
 	db.lastSegmentIndex++
 	return result
 }
 
-func (db *Db) compactOldSegments() {
-	go func() {
-		filePath := db.getNewFileName()
-		newSegment := &Segment{
-			filePath: filePath,
-			index:    make(hashIndex),
-		}
-		var offset int64
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-		if err != nil {
-			return
-		}
-		lastSegmentIndex := len(db.segments) - 2
-		for i := 0; i <= lastSegmentIndex; i++ {
-			s := db.segments[i]
-			s.mu.Lock()
-			for key, index := range s.index {
-				if i < lastSegmentIndex {
-					isInNewerSegments := checkKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key)
-					if isInNewerSegments {
-						continue
-					}
-				}
-				value, _ := s.getFromSegment(index)
-				e := entry{
-					key:   key,
-					value: value,
-				}
-				n, err := f.Write(e.Encode())
-				if err == nil {
-					newSegment.index[key] = offset
-					offset += int64(n)
-				}
-			}
-			s.mu.Unlock()
+// Close stops the put goroutine and scheduled compactions, waits for a running
+// compaction and closes the active segment and the read handles of all
+// segments. Writes fail with ErrClosed afterwards. Calls after the first one
+// do nothing.
+func (db *Db) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		db.closeMu.Lock()
+		close(db.done)
+		db.closeMu.Unlock()
+		<-db.putStopped
+		db.compactions.Wait()
+		for _, s := range db.getSegments() {
+			_ = s.waitSealed(context.Background())
 		}
-		db.segments = []*Segment{newSegment, db.getLastSegment()}
-	}()
-}
-
-func checkKeyInSegments(segments []*Segment, key string) bool {
-	for _, s := range segments {
-		s.mu.Lock()
-		if _, ok := s.index[key]; ok {
-			s.mu.Unlock()
-			return true
+		err = db.closeFile(db.out)
+		for _, s := range db.getSegments() {
+			s.retireFile(nil)
 		}
-		s.mu.Unlock()
-	}
-	return false
+	})
+	return err
 }
 
-func (db *Db) recover() error {
-	var err error
-	var buf [bufSize]byte
-
-	in := bufio.NewReaderSize(db.out, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
+// closeFile closes a segment file, flushing it first unless the sync mode
+// leaves that to the operating system.
+func (db *Db) closeFile(f *os.File) error {
+	if db.opts.syncMode.kind != syncNone {
+		if err := db.syncFile(f); err != nil {
+			_ = f.Close()
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
-
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
-		}
-		n, err = in.Read(data)
-
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
-
-			var e entry
-			e.Decode(data)
-			db.setKey(e.key, int64(n))
-		}
 	}
-	return err
+	return f.Close()
 }
 
-func (db *Db) Close() error {
-	return db.out.Close()
+func (s *Segment) setKey(key string, position int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.(hashIndex)[key] = position
+	s.records++
 }
 
-func (db *Db) setKey(key string, n int64) {
-	db.getLastSegment().mu.Lock()
-	defer db.getLastSegment().mu.Unlock()
-	db.getLastSegment().index[key] = db.outOffset
-	db.outOffset += n
+// getIndex returns the index of the segment.
+func (s *Segment) getIndex() Index {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index
 }
 
-func (db *Db) getSegmentAndPosition(key string) (*Segment, int64, error) {
-	for i := range db.segments {
-		s := db.segments[len(db.segments)-i-1]
-		s.mu.Lock()
-		pos, ok := s.index[key]
+// getPos returns the position of the newest record of the key, nil if it is
+// not indexed. It runs concurrently with writes and other reads.
+func (db *Db) getPos(key string) (*KeyPosition, error) {
+	segments := db.getSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		position, ok, err := segments[i].find(key, &db.bloomStats)
+		if err != nil && segments[i].obsolete.Load() {
+			// The on-disk index was removed by compaction after the segment
+			// list was loaded, the key is now indexed in the merged segment.
+			return db.getPos(key)
+		} else if err != nil {
+			return nil, err
+		}
 		if ok {
-			s.mu.Unlock()
-			return s, pos, nil
+			return &KeyPosition{segment: segments[i], position: position}, nil
 		}
-		s.mu.Unlock()
 	}
+	return nil, nil
+}
 
-	return nil, 0, ErrNotFound
+// lookup returns the position of the key in the segment.
+func (s *Segment) lookup(key string) (int64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.Get(key)
 }
 
-func (db *Db) getPos(key string) *KeyPosition {
-	op := IndexOp{
-		isWrite: false,
-		key:     key,
+// getEntry returns the newest live record of the key. Deleted and expired
+// keys are reported as ErrNotFound.
+func (db *Db) getEntry(key string) (entry, error) {
+	e, err := db.getLatest(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if e.isTombstone() || e.isExpired(db.now()) {
+		return entry{}, ErrNotFound
 	}
-	db.indexOps <- op
-	return <-db.keyPositions
+	return e, nil
 }
 
-func (db *Db) Get(key string) (string, error) {
-	keyPos := db.getPos(key)
+// getLatest returns the newest record of the key, which may be a tombstone or
+// expired.
+func (db *Db) getLatest(key string) (entry, error) {
+	keyPos, err := db.getPos(key)
+	if err != nil {
+		return entry{}, err
+	}
 	if keyPos == nil {
-		return "", ErrNotFound
+		return entry{}, ErrNotFound
+	}
+	e, err := keyPos.segment.getFromSegment(keyPos.position)
+	for err != nil && keyPos.segment.obsolete.Load() {
+		// The segment was merged and removed by compaction after the lookup,
+		// the key is now indexed in the merged segment.
+		if keyPos, err = db.getPos(key); err != nil {
+			return entry{}, err
+		}
+		if keyPos == nil {
+			return entry{}, ErrNotFound
+		}
+		e, err = keyPos.segment.getFromSegment(keyPos.position)
 	}
-	value, err := keyPos.segment.getFromSegment(keyPos.position)
+	return e, err
+}
+
+func (db *Db) Get(key string) (string, error) {
+	e, err := db.getEntry(key)
 	if err != nil {
 		return "", err
 	}
-	return value, nil
+	if e.valueType != TypeString {
+		return "", &TypeMismatchError{Key: key, Expected: TypeString, Actual: e.valueType}
+	}
+	return e.value, nil
+}
+
+// GetInt64 returns a value stored with PutInt64.
+func (db *Db) GetInt64(key string) (int64, error) {
+	e, err := db.getEntry(key)
+	if err != nil {
+		return 0, err
+	}
+	if e.valueType != TypeInt64 {
+		return 0, &TypeMismatchError{Key: key, Expected: TypeInt64, Actual: e.valueType}
+	}
+	return decodeInt64(e.value)
+}
+
+// getSegments returns the current segment list, oldest first. The list is
+// shared and must not be modified.
+func (db *Db) getSegments() []*Segment {
+	return *db.segments.Load()
+}
+
+// setSegments replaces the segment list. It must be called with db.mu held.
+func (db *Db) setSegments(segments []*Segment) {
+	db.segments.Store(&segments)
 }
 
 func (db *Db) getLastSegment() *Segment {
-	return db.segments[len(db.segments)-1]
+	segments := db.getSegments()
+	return segments[len(segments)-1]
 }
 
 func (db *Db) startPutRoutine() {
 	go func() {
+		defer close(db.putStopped)
+		var tick <-chan time.Time
+		if db.opts.syncMode.kind == syncInterval {
+			ticker := time.NewTicker(db.opts.syncMode.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
 		for {
-			e := <-db.putOps
-			length := e.e.getLength()
-			stat, err := db.out.Stat()
-			if err != nil {
-				e.res <- err
-				continue
-			}
-			if stat.Size()+length > db.segmentSize {
-				err := db.createSegment()
-				if err != nil {
-					e.res <- err
-					continue
+			select {
+			case <-db.done:
+				return
+			case op := <-db.putOps:
+				batch := []EntryWithChan{op}
+				if db.opts.syncMode.kind == syncGroupCommit {
+					batch = db.drainPutOps(batch)
 				}
-			}
-			n, err := db.out.Write(e.e.Encode())
-			if err == nil {
-				db.indexOps <- IndexOp{
-					isWrite: true,
-					key:     e.e.key,
-					index:   int64(n),
+				db.commit(batch)
+			case <-tick:
+				if err := db.syncFile(db.out); err != nil {
+					db.opts.logger.Printf("datastore: periodic sync of %s failed: %s", db.outPath, err)
 				}
 			}
-			e.res <- nil
 		}
 	}()
 }
 
+// drainPutOps appends all requests already waiting in putOps to batch.
+func (db *Db) drainPutOps(batch []EntryWithChan) []EntryWithChan {
+	for {
+		select {
+		case op := <-db.putOps:
+			batch = append(batch, op)
+		default:
+			return batch
+		}
+	}
+}
+
+// commit writes every request of the batch, syncs the active segment once if
+// the sync mode requires it and only then answers the callers.
+func (db *Db) commit(batch []EntryWithChan) {
+	errs := make([]error, len(batch))
+	written := false
+	for i := range batch {
+		op := &batch[i]
+		if op.control != nil {
+			errs[i] = op.control()
+			written = written || errs[i] == nil
+			continue
+		}
+		if op.merge != nil {
+			errs[i] = db.resolveMerge(op)
+		}
+		if errs[i] == nil {
+			errs[i] = db.write(op.e)
+			written = written || errs[i] == nil
+		}
+	}
+
+	if written && db.opts.syncMode.syncsOnCommit() {
+		if err := db.syncFile(db.out); err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+	for i, op := range batch {
+		op.res <- errs[i]
+	}
+}
+
+// rotate seals the active segment unless it is still empty.
+func (db *Db) rotate() error {
+	if db.outOffset == db.getLastSegment().start {
+		return nil
+	}
+	return db.createSegment()
+}
+
+// write appends the entry to the active segment, starting a new segment when
+// it does not fit, and publishes its position to the index.
+func (db *Db) write(e entry) error {
+	if err := db.opts.checkSize(&e); err != nil {
+		return err
+	}
+	if err := db.opts.compress(&e); err != nil {
+		return err
+	}
+	stat, err := db.out.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size()+e.getLength() > db.opts.segmentSize {
+		err := db.createSegment()
+		if err != nil {
+			return err
+		}
+	}
+	segment := db.getLastSegment()
+	e.seq = db.seq.Add(1)
+	e.checksum = segment.checksum
+	e.sealer = segment.sealer
+	record := e.Encode()
+	n, err := db.out.Write(record)
+	if err == nil {
+		db.trackExpiry(&e)
+		db.compression.add(&e)
+		segment.addRecordHint(&e, db.outOffset, record)
+		segment.setKey(e.key, db.outOffset)
+		db.outOffset += int64(n)
+	}
+	return err
+}
+
 func (db *Db) Put(key, value string) error {
-	e := entry{
+	return db.put(entry{
 		key:   key,
 		value: value,
+	})
+}
+
+// PutInt64 stores an int64 value that can be read back with GetInt64.
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.put(entry{
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+	})
+}
+
+// runInPutRoutine runs fn in the put goroutine between two writes.
+func (db *Db) runInPutRoutine(fn func() error) error {
+	return db.send(EntryWithChan{control: fn})
+}
+
+func (db *Db) put(e entry) error {
+	return db.send(EntryWithChan{e: e})
+}
+
+// send hands op to the put goroutine and waits for its result. It returns
+// ErrClosed if the Db is closed before the put goroutine takes op.
+func (db *Db) send(op EntryWithChan) error {
+	op.res = make(chan error, 1)
+	select {
+	case db.putOps <- op:
+		return <-op.res
+	case <-db.done:
+		return ErrClosed
 	}
-	res := make(chan error)
-	db.putOps <- EntryWithChan{
-		e:   e,
-		res: res,
-	}
-	return <-res
+}
+
+// Delete removes the key by appending a tombstone record for it. Deleting a
+// key that does not exist is not an error.
+func (db *Db) Delete(key string) error {
+	return db.put(entry{
+		key:  key,
+		kind: kindTombstone,
+	})
 }
 
 type Segment struct {
 	outOffset int64
-
-	index    hashIndex
+	// start is the offset of the first record, past the segment header.
+	start int64
+	// checksum is the algorithm protecting the records of the segment.
+	checksum Checksum
+	// encrypted and keyID come from the segment header, sealer is set once
+	// the key is known.
+	encrypted bool
+	keyID     uint32
+	sealer    *sealer
+	// file is the shared read handle, mapped into memory if mmap is set.
+	file segmentFile
+	mmap bool
+	// bloom is the Bloom filter of the keys, set once the segment is sealed.
+	bloom atomic.Pointer[bloomFilter]
+
+	// index is a hashIndex while the segment is active, and may be replaced
+	// by a diskIndex once it is sealed.
+	index    Index
 	filePath string
-	mu       sync.Mutex
+	// records counts records in the file including shadowed ones.
+	records int
+	// hints collects the hint file entries while the segment is written.
+	hints map[string]hintRecord
+	// nextExpiry is the earliest expiry time of a key of the sealed segment
+	// that has not been swept yet, zero if there is none. It is set before
+	// the segment is published and owned by the put goroutine after.
+	nextExpiry int64
+	// expiries holds the expiry times of the keys until its hint or index
+	// file is written, and for good if that fails, otherwise they are read
+	// from the file when due.
+	expiries map[string]int64
+	// sealing is closed once the filter and the index of a segment sealed by
+	// createSegment are stored, it is nil for other segments.
+	sealing chan struct{}
+	// mu guards index, records and expiries. Only the put goroutine changes
+	// index and records while the segment is active, a sealed segment may
+	// swap its index for a diskIndex.
+	mu sync.RWMutex
+	// obsolete is set once compaction has replaced the segment and its file
+	// is about to be removed.
+	obsolete atomic.Bool
+	// pins counts snapshots reading the segment, removePending is set when
+	// compaction replaced it while pinned. Both are guarded by Db.pinMu.
+	pins          int
+	removePending bool
 }
 
-func (s *Segment) getFromSegment(position int64) (string, error) {
-	file, err := os.Open(s.filePath)
+func (s *Segment) getFromSegment(position int64) (entry, error) {
+	e, err := s.readRecordAt(position)
 	if err != nil {
-		return "", err
+		return e, err
 	}
-	defer file.Close()
+	return e, e.unpack()
+}
 
-	_, err = file.Seek(position, 0)
+// readRecordAt reads and decrypts the record at position leaving a compressed
+// value packed.
+func (s *Segment) readRecordAt(position int64) (entry, error) {
+	f, err := s.acquireFile()
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
+	defer f.release()
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, position); err != nil {
+		return entry{}, err
+	}
+	size := recordSize(header, s.checksum)
+	data := make([]byte, size)
+	n, err := f.ReadAt(data, position)
 	if err != nil {
-		return "", err
+		return entry{}, fmt.Errorf("can't read record bytes (read %d, expected %d): %w", n, size, err)
+	}
+
+	e, err := decodeRecord(data, s.checksum)
+	if err != nil {
+		return e, err
 	}
-	return value, nil
+	return e, e.open(s.sealer)
 }
@@ -1,12 +1,15 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
-	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -16,7 +19,7 @@ func TestDb_Put(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir, 250)
+	db, err := NewDb(dir, 320)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,7 +69,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if size1*2 != outInfo.Size() {
+		if size1*2-segmentHeaderSize != outInfo.Size() {
 			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
 		}
 	})
@@ -111,35 +114,35 @@ func TestDb_Segmentation(t *testing.T) {
 		db.Put("key3", "value3")
 		db.Put("key2", "value5")
 
-		if len(db.segments) != 2 {
-			t.Errorf("Something went wrong with segmentation. Expected 2 files, got %d", len(db.segments))
+		if len(db.getSegments()) != 2 {
+			t.Errorf("Something went wrong with segmentation. Expected 2 files, got %d", len(db.getSegments()))
 		}
 	})
 
 	t.Run("should start segmentation", func(t *testing.T) {
 		db.Put("key4", "value4")
 
-		if len(db.segments) != 3 {
-			t.Errorf("Something went wrong with segmentation. Expected 3 files, got %d", len(db.segments))
+		// The third segment registers a background compaction before Put
+		// returns, so waiting for it makes the result independent of timing.
+		db.compactions.Wait()
+		if len(db.getSegments()) != 2 {
+			t.Errorf("Something went wrong with segmentation. Expected 2 files, got %d", len(db.getSegments()))
 		}
-
-		time.Sleep(2 * time.Second)
-
-		if len(db.segments) != 2 {
-			t.Errorf("Something went wrong with segmentation. Expected 2 files, got %d", len(db.segments))
+		if stats := db.lastCompaction.Load(); stats == nil || stats.Segments != 2 {
+			t.Errorf("Expected a compaction of 2 sealed segments, got %+v", stats)
 		}
 	})
 
 	t.Run("shouldn't store duplicates", func(t *testing.T) {
-		file, err := os.Open(db.segments[0].filePath)
+		file, err := os.Open(db.getSegments()[0].filePath)
 		defer file.Close()
 
 		if err != nil {
 			t.Error(err)
 		}
 		inf, _ := file.Stat()
-		if inf.Size() != 126 {
-			t.Errorf("Something went wrong with segmentation. Expected size 66, got %d", inf.Size())
+		if inf.Size() != 116 {
+			t.Errorf("Something went wrong with segmentation. Expected size 116, got %d", inf.Size())
 		}
 	})
 
@@ -174,14 +177,314 @@ func TestDb_Checksum(t *testing.T) {
 	})
 
 	file, _ := os.OpenFile(db.outPath, os.O_RDWR, 0o655)
-	file.WriteAt([]byte{0x59}, int64(3))
+	file.WriteAt([]byte{0x59}, segmentHeaderSize+3)
 	file.Close()
 
 	t.Run("shouldn't get value", func(t *testing.T) {
 		_, err := db.Get("key1")
-		if err == nil || !strings.Contains(err.Error(), "SHA1") {
+		if err == nil || !strings.Contains(err.Error(), "checksum") {
 			t.Errorf("No error occured while getting value")
 		}
 	})
 
 }
+
+func TestDb_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := [][]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+		{"key3", "value3"},
+		{"key2", "value5"},
+		{"key4", "value4"},
+		{"key1", "value6"},
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := map[string]string{
+		"key1": "value6",
+		"key2": "value5",
+		"key3": "value3",
+		"key4": "value4",
+	}
+	for key, want := range expected {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		}
+		if value != want {
+			t.Errorf("Bad value returned expected %s, got %s", want, value)
+		}
+	}
+
+	t.Run("appends to the newest segment", func(t *testing.T) {
+		if db.outPath != db.getLastSegment().filePath {
+			t.Errorf("Expected to write into %s, got %s", db.getLastSegment().filePath, db.outPath)
+		}
+		if err := db.Put("key5", "value7"); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("key5")
+		if err != nil || value != "value7" {
+			t.Errorf("Bad value returned expected value7, got %s (%v)", value, err)
+		}
+	})
+}
+
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("deleted key is not found", func(t *testing.T) {
+		db.Put("key1", "value1")
+		if err := db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if err := db.Delete("missing"); err != nil {
+			t.Errorf("Cannot delete missing key: %s", err)
+		}
+	})
+
+	t.Run("compaction drops tombstones", func(t *testing.T) {
+		db.Put("key2", "value2")
+		db.Put("key3", "value3")
+		db.Put("key4", "value4")
+		db.compactions.Wait()
+
+		if len(db.getSegments()) != 2 {
+			t.Fatalf("Expected 2 segments after compaction, got %d", len(db.getSegments()))
+		}
+		for _, key := range []string{"key1", "missing"} {
+			if _, ok, _ := db.getSegments()[0].index.Get(key); ok {
+				t.Errorf("Compacted segment still contains %s", key)
+			}
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("delete survives restart", func(t *testing.T) {
+		db.Put("key5", "value5")
+		db.Delete("key5")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"key1", "key5"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+			}
+		}
+		if value, err := db.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("Bad value returned expected value2, got %s", value)
+		}
+	})
+}
+
+func TestDb_Int64(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutInt64("counter", -42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get int64", func(t *testing.T) {
+		value, err := db.GetInt64("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != -42 {
+			t.Errorf("Bad value returned expected -42, got %d", value)
+		}
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		var mismatch *TypeMismatchError
+		if _, err := db.Get("counter"); !errors.As(err, &mismatch) || mismatch.Actual != TypeInt64 {
+			t.Errorf("Expected type mismatch error, got %v", err)
+		}
+		if _, err := db.GetInt64("name"); !errors.As(err, &mismatch) || mismatch.Actual != TypeString {
+			t.Errorf("Expected type mismatch error, got %v", err)
+		}
+		if _, err := db.GetInt64("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("type survives restart", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.GetInt64("counter")
+		if err != nil || value != -42 {
+			t.Errorf("Bad value returned expected -42, got %d (%v)", value, err)
+		}
+	})
+}
+
+func TestDb_ConcurrentReadsAndWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithCompactionThreshold(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("key%d", i), "0")
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := db.Get(fmt.Sprintf("key%d", i%10)); err != nil {
+					t.Errorf("Cannot read key%d while writing: %s", i%10, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 300; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprint(290+i) {
+			t.Errorf("Bad value of key%d returned expected %d, got %s (%v)", i, 290+i, value, err)
+		}
+	}
+}
+
+// BenchmarkDb_ParallelGet reads from all goroutines at once with GOMAXPROCS
+// raised step by step, with and without a concurrent writer. Reads do not
+// wait for each other, so the time per read drops as GOMAXPROCS grows.
+func BenchmarkDb_ParallelGet(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keys = 10000
+	db, err := NewDb(dir, 1<<20, WithCompactionInterval(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value of key %d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, writing := range []bool{false, true} {
+		for procs := 1; procs <= runtime.NumCPU(); procs *= 2 {
+			b.Run(fmt.Sprintf("procs %d writing %v", procs, writing), func(b *testing.B) {
+				runtime.GOMAXPROCS(procs)
+				stop := make(chan struct{})
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for i := 0; writing; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+							if err := db.Put(fmt.Sprintf("key%d", i%keys), "new value"); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}
+				}()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+							// Fatal must not be called from the parallel goroutines.
+							b.Error(err)
+							return
+						}
+					}
+				})
+				b.StopTimer()
+				close(stop)
+				<-done
+			})
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The on-disk index of a sealed segment is stored next to it in a file
+// holding the index entries sorted by key and split into blocks, followed by
+// the expiry times of keys whose newest record expires, the first key of
+// every block and a trailer
+//
+//	block*    | expiries | block keys | trailer
+//	block     = entry* | crc32c of the entries u32
+//	entry     = shared uvarint | suffix length uvarint | suffix | position uvarint
+//	expiries  = (key length uvarint | key | expires at varint)*
+//	block key = key length uvarint | key | block offset uvarint
+//	trailer   = segment size u64 | records u64 | keys u64 | expiries offset u64 |
+//	            block keys offset u64 | sha1 of everything from expiries on
+//
+// An entry stores its key as the length of the prefix shared with the key
+// before it in the block and the rest. Only the block keys are kept in memory,
+// a lookup reads a single block. Blocks, expiries and block keys of an
+// encrypted segment are sealed one by one with the key of the segment. An
+// index that is missing, fails its checksum or does not match the size of its
+// segment is rebuilt on startup.
+const (
+	indexSuffix      = ".index"
+	indexTrailerSize = 40 + sha1.Size
+	blockSumSize     = 4
+)
+
+var errBadIndex = errors.New("index file is invalid")
+
+func indexPath(segmentPath string) string {
+	return segmentPath + indexSuffix
+}
+
+// diskIndex is the Index of a sealed segment kept in an index file.
+type diskIndex struct {
+	path   string
+	mmap   bool
+	sealer *sealer
+	file   segmentFile
+	keys   int
+	// blockKeys holds the first key of every block, offsets the offset of
+	// every block and the end of the last one.
+	blockKeys []string
+	offsets   []int64
+}
+
+func (d *diskIndex) Len() int {
+	return d.keys
+}
+
+// findBlock returns the number of the block that may hold key, -1 if key is
+// less than all keys of the index.
+func (d *diskIndex) findBlock(key string) int {
+	return sort.Search(len(d.blockKeys), func(i int) bool {
+		return d.blockKeys[i] > key
+	}) - 1
+}
+
+func (d *diskIndex) Get(key string) (int64, bool, error) {
+	i := d.findBlock(key)
+	if i < 0 {
+		return 0, false, nil
+	}
+	data, err := d.readBlock(i)
+	if err != nil {
+		return 0, false, err
+	}
+	k := []byte(key)
+	r := blockReader{data: data}
+	for r.next() {
+		switch bytes.Compare(r.key, k) {
+		case 0:
+			return r.position, true, nil
+		case 1:
+			return 0, false, nil
+		}
+	}
+	return 0, false, r.err
+}
+
+// Range calls fn for keys in ascending order.
+func (d *diskIndex) Range(prefix, from string, fn func(key string, position int64) error) error {
+	if from < prefix {
+		from = prefix
+	}
+	i := d.findBlock(from)
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(d.blockKeys); i++ {
+		data, err := d.readBlock(i)
+		if err != nil {
+			return err
+		}
+		r := blockReader{data: data}
+		for r.next() {
+			key := string(r.key)
+			if key < from {
+				continue
+			}
+			// Keys with the prefix that are not less than from follow each
+			// other, so the first one without it ends the range.
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if err := fn(key, r.position); err != nil {
+				return err
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// readBlock reads and verifies block i.
+func (d *diskIndex) readBlock(i int) ([]byte, error) {
+	f, err := d.file.acquire(d.path, d.mmap)
+	if err != nil {
+		return nil, err
+	}
+	defer f.release()
+
+	data := make([]byte, d.offsets[i+1]-d.offsets[i])
+	if _, err := f.ReadAt(data, d.offsets[i]); err != nil {
+		return nil, err
+	}
+	if d.sealer != nil {
+		if data, err = d.sealer.open(data, nil); err != nil {
+			return nil, fmt.Errorf("%w: block %d: %s", errBadIndex, i, err)
+		}
+	}
+	if len(data) < blockSumSize {
+		return nil, fmt.Errorf("%w: block %d is too short", errBadIndex, i)
+	}
+	entries := data[:len(data)-blockSumSize]
+	if crc32.Checksum(entries, castagnoli) != binary.LittleEndian.Uint32(data[len(entries):]) {
+		return nil, fmt.Errorf("%w: bad checksum of block %d", errBadIndex, i)
+	}
+	return entries, nil
+}
+
+// cursor returns a cursor over the keys of the index starting with prefix
+// that are not less than from, reading one block at a time. from must not be
+// less than prefix.
+func (d *diskIndex) cursor(prefix, from string) indexCursor {
+	block := d.findBlock(from)
+	if block < 0 {
+		block = 0
+	}
+	return &blockCursor{index: d, prefix: prefix, from: from, block: block - 1}
+}
+
+type blockCursor struct {
+	index        *diskIndex
+	prefix, from string
+	block        int
+	r            blockReader
+	done         bool
+}
+
+func (c *blockCursor) next() (string, int64, bool, error) {
+	for !c.done {
+		for !c.r.next() {
+			if c.r.err != nil {
+				return "", 0, false, c.r.err
+			}
+			if c.block+1 >= len(c.index.blockKeys) {
+				return "", 0, false, nil
+			}
+			c.block++
+			data, err := c.index.readBlock(c.block)
+			if err != nil {
+				return "", 0, false, err
+			}
+			c.r = blockReader{data: data}
+		}
+		key := string(c.r.key)
+		if key < c.from {
+			continue
+		}
+		// As in Range the first key without the prefix ends the keys.
+		if !strings.HasPrefix(key, c.prefix) {
+			c.done = true
+			break
+		}
+		return key, c.r.position, true, nil
+	}
+	return "", 0, false, nil
+}
+
+// blockReader decodes the entries of a block.
+type blockReader struct {
+	data     []byte
+	key      []byte
+	position int64
+	err      error
+}
+
+func (r *blockReader) next() bool {
+	if len(r.data) == 0 || r.err != nil {
+		return false
+	}
+	shared, n1 := binary.Uvarint(r.data)
+	suffix, n2 := uvarintAt(r.data, n1)
+	if n1 <= 0 || n2 <= 0 || shared > uint64(len(r.key)) || suffix > uint64(len(r.data)-n1-n2) {
+		r.err = fmt.Errorf("%w: bad entry", errBadIndex)
+		return false
+	}
+	rest := r.data[n1+n2:]
+	r.key = append(r.key[:shared], rest[:suffix]...)
+	position, n3 := binary.Uvarint(rest[suffix:])
+	if n3 <= 0 {
+		r.err = fmt.Errorf("%w: bad entry", errBadIndex)
+		return false
+	}
+	r.position = int64(position)
+	r.data = rest[suffix+uint64(n3):]
+	return true
+}
+
+// uvarintAt decodes a uvarint that follows the first n bytes of data. It
+// returns a non-positive size if n is not.
+func uvarintAt(data []byte, n int) (uint64, int) {
+	if n <= 0 {
+		return 0, n
+	}
+	return binary.Uvarint(data[n:])
+}
+
+// indexWriter writes an index file from keys added in ascending order.
+type indexWriter struct {
+	path      string
+	f         *os.File
+	w         *bufio.Writer
+	sealer    *sealer
+	mmap      bool
+	blockSize int
+	offset    int64
+	block     []byte
+	prev      string
+	keys      int
+	blockKeys []string
+	offsets   []int64
+	expiries  map[string]int64
+}
+
+// newIndexWriter starts the index file of the segment s under a temporary
+// name. It must be finished or aborted.
+func newIndexWriter(s *Segment, blockSize int, mode os.FileMode) (*indexWriter, error) {
+	path := indexPath(s.filePath)
+	f, err := os.OpenFile(path+tmpSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &indexWriter{
+		path:      path,
+		f:         f,
+		w:         bufio.NewWriterSize(f, bufSize),
+		sealer:    s.sealer,
+		mmap:      s.mmap,
+		blockSize: blockSize,
+		expiries:  make(map[string]int64),
+	}, nil
+}
+
+// add indexes key at position. Keys must be added in ascending order. A zero
+// expiresAt means that the record does not expire.
+func (w *indexWriter) add(key string, position, expiresAt int64) error {
+	if len(w.block) == 0 {
+		w.blockKeys = append(w.blockKeys, key)
+		w.offsets = append(w.offsets, w.offset)
+		w.prev = ""
+	}
+	shared := 0
+	for shared < len(key) && shared < len(w.prev) && key[shared] == w.prev[shared] {
+		shared++
+	}
+	w.block = binary.AppendUvarint(w.block, uint64(shared))
+	w.block = binary.AppendUvarint(w.block, uint64(len(key)-shared))
+	w.block = append(w.block, key[shared:]...)
+	w.block = binary.AppendUvarint(w.block, uint64(position))
+	w.prev = key
+	w.keys++
+	if expiresAt != 0 {
+		w.expiries[key] = expiresAt
+	}
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *indexWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.block = binary.LittleEndian.AppendUint32(w.block, crc32.Checksum(w.block, castagnoli))
+	err := w.write(w.block)
+	w.block = w.block[:0]
+	return err
+}
+
+// write appends data to the file, sealed if the segment is encrypted.
+func (w *indexWriter) write(data []byte) error {
+	if w.sealer != nil {
+		data = w.sealer.seal(data, nil)
+	}
+	n, err := w.w.Write(data)
+	w.offset += int64(n)
+	return err
+}
+
+// finish writes the rest of the index, flushes it to disk and renames it to
+// its final name. It returns the index ready for lookups.
+func (w *indexWriter) finish(segmentSize int64, records int) (*diskIndex, error) {
+	err := w.flushBlock()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	end := w.offset
+	tail := w.encodeTail(segmentSize, records, end)
+	_, err = w.w.Write(tail)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	w.f = nil
+	if err == nil {
+		err = os.Rename(w.path+tmpSuffix, w.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(w.path))
+	}
+	if err != nil {
+		_ = os.Remove(w.path + tmpSuffix)
+		return nil, err
+	}
+	return &diskIndex{
+		path:      w.path,
+		mmap:      w.mmap,
+		sealer:    w.sealer,
+		keys:      w.keys,
+		blockKeys: w.blockKeys,
+		offsets:   append(w.offsets, end),
+	}, nil
+}
+
+// encodeTail returns the expiries, block keys and trailer of an index whose
+// blocks end at end.
+func (w *indexWriter) encodeTail(segmentSize int64, records int, end int64) []byte {
+	var expiries []byte
+	for key, expiresAt := range w.expiries {
+		expiries = binary.AppendUvarint(expiries, uint64(len(key)))
+		expiries = append(expiries, key...)
+		expiries = binary.AppendVarint(expiries, expiresAt)
+	}
+	var blockKeys []byte
+	for i, key := range w.blockKeys {
+		blockKeys = binary.AppendUvarint(blockKeys, uint64(len(key)))
+		blockKeys = append(blockKeys, key...)
+		blockKeys = binary.AppendUvarint(blockKeys, uint64(w.offsets[i]))
+	}
+	if w.sealer != nil {
+		expiries = w.sealer.seal(expiries, nil)
+		blockKeys = w.sealer.seal(blockKeys, nil)
+	}
+
+	tail := append(expiries, blockKeys...)
+	trailer := make([]byte, indexTrailerSize-sha1.Size)
+	binary.LittleEndian.PutUint64(trailer, uint64(segmentSize))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(records))
+	binary.LittleEndian.PutUint64(trailer[16:], uint64(w.keys))
+	binary.LittleEndian.PutUint64(trailer[24:], uint64(end))
+	binary.LittleEndian.PutUint64(trailer[32:], uint64(end)+uint64(len(expiries)))
+	tail = append(tail, trailer...)
+	sum := sha1.Sum(tail)
+	return append(tail, sum[:]...)
+}
+
+// abort removes the unfinished index file. It does nothing once the index is
+// finished.
+func (w *indexWriter) abort() {
+	if w.f == nil {
+		return
+	}
+	_ = w.f.Close()
+	_ = os.Remove(w.path + tmpSuffix)
+	w.f = nil
+}
+
+// openDiskIndex reads the block keys of the index of the segment at
+// segmentPath, which must have segmentSize bytes. It returns the index, the
+// number of records in the segment and expiry times of keys whose newest
+// record in the segment expires.
+func openDiskIndex(segmentPath string, segmentSize int64, sealer *sealer, mmap bool) (*diskIndex, int, map[string]int64, error) {
+	path := indexPath(segmentPath)
+	t, err := readIndexTail(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if indexed := int64(binary.LittleEndian.Uint64(t.trailer)); indexed != segmentSize {
+		return nil, 0, nil, fmt.Errorf("%w: segment has %d bytes, index expects %d", errBadIndex, segmentSize, indexed)
+	}
+
+	d := &diskIndex{
+		path:   path,
+		mmap:   mmap,
+		sealer: sealer,
+		keys:   int(binary.LittleEndian.Uint64(t.trailer[16:])),
+	}
+	records := int(binary.LittleEndian.Uint64(t.trailer[8:]))
+	expiries, err := decodeIndexExpiries(t.expiries, sealer)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	blockKeysData := t.blockKeys
+	if sealer != nil {
+		if blockKeysData, err = sealer.open(blockKeysData, nil); err != nil {
+			return nil, 0, nil, fmt.Errorf("%w: %s", errBadIndex, err)
+		}
+	}
+	end := t.end
+	for len(blockKeysData) > 0 {
+		key, rest, ok := readIndexKey(blockKeysData)
+		offset, n := binary.Uvarint(rest)
+		if !ok || n <= 0 || (len(d.offsets) > 0 && int64(offset) <= d.offsets[len(d.offsets)-1]) || int64(offset) >= end {
+			return nil, 0, nil, fmt.Errorf("%w: bad block key", errBadIndex)
+		}
+		d.blockKeys = append(d.blockKeys, key)
+		d.offsets = append(d.offsets, int64(offset))
+		blockKeysData = rest[n:]
+	}
+	if (len(d.offsets) > 0 && d.offsets[0] != 0) || (len(d.offsets) == 0) != (end == 0) {
+		return nil, 0, nil, fmt.Errorf("%w: bad block keys", errBadIndex)
+	}
+	d.offsets = append(d.offsets, end)
+	return d, records, expiries, nil
+}
+
+// indexTail holds the sections of an index file that follow its blocks.
+type indexTail struct {
+	expiries, blockKeys, trailer []byte
+	// end is the end of the blocks.
+	end int64
+}
+
+// readIndexTail reads and verifies everything after the blocks of an index
+// file.
+func readIndexTail(path string) (*indexTail, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size < indexTrailerSize {
+		return nil, errBadIndex
+	}
+	trailer := make([]byte, indexTrailerSize)
+	if _, err := f.ReadAt(trailer, size-indexTrailerSize); err != nil {
+		return nil, err
+	}
+	end := int64(binary.LittleEndian.Uint64(trailer[24:]))
+	blockKeysOffset := int64(binary.LittleEndian.Uint64(trailer[32:]))
+	if end < 0 || blockKeysOffset < end || blockKeysOffset > size-indexTrailerSize {
+		return nil, fmt.Errorf("%w: bad trailer", errBadIndex)
+	}
+	tail := make([]byte, size-end)
+	if _, err := f.ReadAt(tail, end); err != nil {
+		return nil, err
+	}
+	body := tail[:len(tail)-sha1.Size]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], tail[len(body):]) {
+		return nil, fmt.Errorf("%w: bad checksum", errBadIndex)
+	}
+	return &indexTail{
+		expiries:  tail[:blockKeysOffset-end],
+		blockKeys: tail[blockKeysOffset-end : len(tail)-indexTrailerSize],
+		trailer:   tail[len(tail)-indexTrailerSize:],
+		end:       end,
+	}, nil
+}
+
+func decodeIndexExpiries(data []byte, sealer *sealer) (map[string]int64, error) {
+	if sealer != nil {
+		var err error
+		if data, err = sealer.open(data, nil); err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadIndex, err)
+		}
+	}
+	expiries := make(map[string]int64)
+	for len(data) > 0 {
+		key, rest, ok := readIndexKey(data)
+		expiresAt, n := binary.Varint(rest)
+		if !ok || n <= 0 {
+			return nil, fmt.Errorf("%w: bad expiry", errBadIndex)
+		}
+		expiries[key] = expiresAt
+		data = rest[n:]
+	}
+	return expiries, nil
+}
+
+// readExpiries reads expiry times of keys whose newest record in the segment
+// expires from the index file.
+func (d *diskIndex) readExpiries() (map[string]int64, error) {
+	t, err := readIndexTail(d.path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndexExpiries(t.expiries, d.sealer)
+}
+
+// readIndexKey decodes a length-prefixed key returning the bytes after it.
+func readIndexKey(data []byte) (string, []byte, bool) {
+	kl, n := binary.Uvarint(data)
+	if n <= 0 || kl > uint64(len(data)-n) {
+		return "", nil, false
+	}
+	return string(data[n : n+int(kl)]), data[n+int(kl):], true
+}
+
+// writeDiskIndex moves the in-memory index of a segment that will not be
+// written anymore to its index file and makes lookups use the file. expiries
+// holds expiry times of keys whose newest record in the segment expires.
+func (s *Segment) writeDiskIndex(blockSize int, expiries map[string]int64, mode os.FileMode) error {
+	s.mu.RLock()
+	index, ok := s.index.(hashIndex)
+	records := s.records
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w, err := newIndexWriter(s, blockSize, mode)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := w.add(key, index[key], expiries[key]); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	d, err := w.finish(s.outOffset, records)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.index = d
+	s.mu.Unlock()
+	return nil
+}
+
+// loadDiskIndex opens the index file of a sealed segment and returns expiry
+// times of keys whose newest record in the segment expires.
+func (s *Segment) loadDiskIndex() (map[string]int64, error) {
+	stat, err := os.Stat(s.filePath)
+	if err != nil {
+		return nil, err
+	}
+	d, records, expiries, err := openDiskIndex(s.filePath, stat.Size(), s.sealer, s.mmap)
+	if err != nil {
+		return nil, err
+	}
+	s.index = d
+	s.outOffset = stat.Size()
+	s.records = records
+	return expiries, nil
+}
+
+// sealIndex stores the index and the expiry times of a segment that was just
+// sealed: in its hint file, or with WithDiskIndex in its index file, which
+// then replaces the in-memory index. The segment keeps its in-memory index and
+// expiry times if that fails.
+func (db *Db) sealIndex(s *Segment, expiries map[string]int64) {
+	var err error
+	if db.opts.indexBlockSize == 0 {
+		if err = s.writeHint(db.opts.fileMode); err != nil {
+			db.opts.logger.Printf("datastore: cannot write hint for %s: %s", s.filePath, err)
+		}
+	} else if err = s.writeDiskIndex(db.opts.indexBlockSize, expiries, db.opts.fileMode); err != nil {
+		db.opts.logger.Printf("datastore: cannot write index for %s: %s", s.filePath, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.expiries = expiries
+	} else {
+		s.expiries = nil
+	}
+}
@@ -0,0 +1,337 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Segment{filePath: filepath.Join(dir, outFileName+"0")}
+	w, err := newIndexWriter(s, 64, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		var expiresAt int64
+		if i%100 == 0 {
+			expiresAt = int64(i + 1)
+		}
+		if err := w.add(fmt.Sprintf("key%04d", i), int64(i*10), expiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.finish(4096, 1500); err != nil {
+		t.Fatal(err)
+	}
+
+	d, records, expiries, err := openDiskIndex(s.filePath, 4096, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 1000 || records != 1500 || len(expiries) != 10 || expiries["key0100"] != 101 {
+		t.Errorf("Unexpected index of %d keys, %d records and expiries %v", d.Len(), records, expiries)
+	}
+	if len(d.blockKeys) < 10 {
+		t.Errorf("Expected many blocks, got %d", len(d.blockKeys))
+	}
+	for i := 0; i < 1000; i++ {
+		if position, ok, err := d.Get(fmt.Sprintf("key%04d", i)); err != nil || !ok || position != int64(i*10) {
+			t.Fatalf("Bad position of key%04d returned: %d %v (%v)", i, position, ok, err)
+		}
+	}
+	for _, key := range []string{"a", "key0005x", "key", "zzz"} {
+		if _, ok, err := d.Get(key); err != nil || ok {
+			t.Errorf("Expected %q to be missing, got %v (%v)", key, ok, err)
+		}
+	}
+
+	var keys []string
+	err = d.Range("key01", "key015", func(key string, _ int64) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 50 || keys[0] != "key0150" || keys[49] != "key0199" {
+		t.Errorf("Unexpected range of %d keys %v", len(keys), keys)
+	}
+
+	newer := hashIndex{"key0001": 7, "new": 8}
+	count := 0
+	err = mergeIndexes([]Index{d, newer}, func(key string, newest int, position int64) error {
+		if key == "key0001" && (newest != 1 || position != 7) {
+			t.Errorf("Expected key0001 from the newer index, got index %d position %d", newest, position)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != 1001 {
+		t.Errorf("Expected 1001 merged keys, got %d (%v)", count, err)
+	}
+
+	if _, _, _, err := openDiskIndex(s.filePath, 4000, nil, false); !errors.Is(err, errBadIndex) {
+		t.Errorf("Expected errBadIndex for a wrong segment size, got %v", err)
+	}
+	f, err := os.OpenFile(indexPath(s.filePath), os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, 3)
+	f.Close()
+	if _, _, err := d.Get("key0000"); !errors.Is(err, errBadIndex) {
+		t.Errorf("Expected errBadIndex for a corrupted block, got %v", err)
+	}
+}
+
+func TestDb_DiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(dir string, opts ...Option) (*Db, RecoveryReport) {
+		t.Helper()
+		var report RecoveryReport
+		opts = append([]Option{
+			WithCompactionInterval(0),
+			WithCompactionThreshold(100),
+			WithDiskIndex(64),
+			WithRecoveryHandler(func(r RecoveryReport) { report = r }),
+		}, opts...)
+		db, err := NewDb(dir, 300, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, report
+	}
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for i := 0; i < 30; i++ {
+			value, err := db.Get(fmt.Sprintf("key%d", i))
+			if i == 3 {
+				if err != ErrNotFound {
+					t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+				}
+				continue
+			}
+			if err != nil || value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value of key%d returned (%v)", i, err)
+			}
+		}
+		if value, err := db.Get("ttl"); err != nil || value != "value" {
+			t.Errorf("Bad value of ttl returned (%v)", err)
+		}
+		it := db.Scan("key1", "", 0)
+		defer it.Close()
+		count := 0
+		for it.Next() {
+			count++
+		}
+		if it.Err() != nil || count != 11 {
+			t.Errorf("Expected 11 keys with prefix key1, got %d (%v)", count, it.Err())
+		}
+	}
+
+	t.Run("sealed segments", func(t *testing.T) {
+		db, _ := open(dir)
+		defer db.Close()
+		db.PutWithTTL("ttl", "value", time.Hour)
+		for i := 0; i < 30; i++ {
+			db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+		db.Delete("key3")
+		check(t, db)
+		waitSealed(t, db)
+		segments := db.getSegments()
+		if len(segments) < 3 {
+			t.Fatalf("Expected at least 3 segments, got %d", len(segments))
+		}
+		for _, s := range segments[:len(segments)-1] {
+			if _, ok := s.getIndex().(*diskIndex); !ok {
+				t.Errorf("Expected an on-disk index for %s", s.filePath)
+			}
+			if _, err := os.Stat(hintPath(s.filePath)); !os.IsNotExist(err) {
+				t.Errorf("Expected no hint for %s, got %v", s.filePath, err)
+			}
+		}
+		if _, ok := db.getLastSegment().getIndex().(hashIndex); !ok {
+			t.Error("Expected the active segment to keep its index in memory")
+		}
+		check(t, db)
+	})
+
+	t.Run("reopened", func(t *testing.T) {
+		db, report := open(dir)
+		defer db.Close()
+		if report.IndexedSegments != report.Segments-1 || report.HintedSegments != 0 {
+			t.Errorf("Unexpected recovery report %+v", report)
+		}
+		first := db.getSegments()[0]
+		expiries, err := first.sealedExpiries()
+		if err != nil || expiries["ttl"] == 0 || first.nextExpiry != expiries["ttl"] {
+			t.Errorf("Expected the expiry of ttl to be read from the index, got %v (%v)", expiries, err)
+		}
+		check(t, db)
+	})
+
+	t.Run("indexes are rebuilt", func(t *testing.T) {
+		paths, _, err := findSegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(indexPath(paths[0])); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(indexPath(paths[1]), []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, report := open(dir)
+		defer db.Close()
+		if report.IndexedSegments != report.Segments-3 {
+			t.Errorf("Expected 2 rebuilt indexes, got report %+v", report)
+		}
+		if _, err := os.Stat(indexPath(paths[0])); err != nil {
+			t.Errorf("Expected the missing index to be written again: %s", err)
+		}
+		check(t, db)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		db, _ := open(dir)
+		defer db.Close()
+		for i := 10; i < 30; i++ {
+			db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+		if db.GarbageRatio() <= 0 {
+			t.Errorf("Expected garbage before compaction, got %g", db.GarbageRatio())
+		}
+		if _, err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		segments := db.getSegments()
+		if len(segments) != 2 {
+			t.Fatalf("Expected 2 segments after compaction, got %d", len(segments))
+		}
+		if _, ok := segments[0].getIndex().(*diskIndex); !ok {
+			t.Error("Expected an on-disk index for the merged segment")
+		}
+		if ratio := db.GarbageRatio(); ratio != 0 {
+			t.Errorf("Expected no garbage after compaction, got %g", ratio)
+		}
+		check(t, db)
+	})
+
+	t.Run("scan during compaction", func(t *testing.T) {
+		db, _ := open(dir)
+		defer db.Close()
+		for i := 0; i < 30; i++ {
+			if i != 3 {
+				db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+			}
+		}
+		it := db.Scan("key", "", 0)
+		defer it.Close()
+		var keys []string
+		for len(keys) < 5 && it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if _, err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if it.Err() != nil || len(keys) != 29 || !sort.StringsAreSorted(keys) {
+			t.Errorf("Expected 29 sorted keys, got %v (%v)", keys, it.Err())
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		keys, _ := ParseKeyRing("1:000102030405060708090a0b0c0d0e0f")
+
+		db, _ := open(dir, WithEncryption(keys))
+		for i := 0; i < 30; i++ {
+			db.Put(fmt.Sprintf("secret%d", i), "value")
+		}
+		db.Close()
+		db, report := open(dir, WithEncryption(keys))
+		defer db.Close()
+		if report.IndexedSegments == 0 {
+			t.Errorf("Expected indexed segments, got report %+v", report)
+		}
+		for i := 0; i < 30; i++ {
+			if value, err := db.Get(fmt.Sprintf("secret%d", i)); err != nil || value != "value" {
+				t.Errorf("Bad value of secret%d returned (%v)", i, err)
+			}
+		}
+		paths, _, _ := findSegmentFiles(dir)
+		for _, path := range paths[:len(paths)-1] {
+			data, err := os.ReadFile(indexPath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("secret")) {
+				t.Errorf("%s contains keys in plain text", indexPath(path))
+			}
+		}
+	})
+}
+
+func TestDb_DiskIndexRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ring, _ := ParseKeyRing("1:000102030405060708090a0b0c0d0e0f")
+	keys := &failingKeys{KeyRing: ring}
+	db, err := NewDb(dir, 1000, WithCompactionInterval(0), WithEncryption(keys), WithDiskIndex(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	keys.fail.Store(true)
+	if _, err := db.Compact(context.Background()); err == nil {
+		t.Fatal("Expected compaction to fail without keys")
+	}
+	keys.fail.Store(false)
+	if _, ok := db.getLastSegment().getIndex().(hashIndex); !ok {
+		t.Fatal("Expected the active segment to keep its index in memory")
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Bad value of %s returned (%v)", key, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Records of an encrypted segment have flagSealed set. Their key and value
+// are sealed together with AES-GCM and stored as
+//
+//	nonce [12]byte | ciphertext of key and value | tag [16]byte
+//
+// in place of the key and the value. The key length in the record header is
+// the length of the plain key, the value length includes the nonce and the
+// tag. Everything before the key is authenticated as additional data, and the
+// checksum covers the sealed form, so torn writes are found without the key.
+// Batch headers hold only a count and are not sealed.
+const (
+	cipherAESGCM  = 1
+	sealNonceSize = 12
+	sealOverhead  = sealNonceSize + 16
+)
+
+var (
+	// ErrUnknownKey is returned by KeyProvider implementations for IDs they
+	// do not have.
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	errNoKeyProvider = errors.New("segment is encrypted but no key provider is configured")
+	errDecrypt       = errors.New("record cannot be decrypted")
+)
+
+// KeyProvider supplies AES keys for segment encryption. The ID of the key is
+// stored in every segment it encrypts, so a key must stay available for as
+// long as such segments exist. Compaction rewrites segments with the current
+// key, after that older keys are no longer needed.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key that encrypts new segments.
+	CurrentKeyID() uint32
+	// Key returns the 16, 24 or 32 byte AES key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider that holds keys in memory. The key added last is
+// the current one.
+type KeyRing struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// Add adds a key and makes it the current one.
+func (r *KeyRing) Add(id uint32, key []byte) {
+	if r.keys == nil {
+		r.keys = make(map[uint32][]byte)
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	r.current = id
+}
+
+func (r *KeyRing) CurrentKeyID() uint32 {
+	return r.current
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// ParseKeyRing parses keys written as id:hex-key separated by commas or new
+// lines, the last one becoming the current key. Empty lines and lines starting
+// with # are ignored.
+func ParseKeyRing(s string) (*KeyRing, error) {
+	r := new(KeyRing)
+	for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idText, keyText, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad encryption key %q: expected id:hex-key", line)
+		}
+		id, err := strconv.ParseUint(idText, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key id %q: %w", idText, err)
+		}
+		key, err := hex.DecodeString(keyText)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %w", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %w", id, err)
+		}
+		r.Add(uint32(id), key)
+	}
+	if r.keys == nil {
+		return nil, errors.New("no encryption keys given")
+	}
+	return r, nil
+}
+
+// sealer encrypts records of a segment with one key.
+type sealer struct {
+	keyID uint32
+	aead  cipher.AEAD
+}
+
+func newSealer(id uint32, key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad encryption key %d: %w", id, err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, sealNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{keyID: id, aead: aead}, nil
+}
+
+// seal returns the nonce followed by the sealed plaintext.
+func (s *sealer) seal(plaintext, aad []byte) []byte {
+	out := make([]byte, sealNonceSize, sealNonceSize+len(plaintext)+sealOverhead)
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		// The system random generator does not fail on supported platforms.
+		panic(fmt.Sprintf("datastore: cannot generate a nonce: %s", err))
+	}
+	return s.aead.Seal(out, out, plaintext, aad)
+}
+
+func (s *sealer) open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, errDecrypt
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:sealNonceSize], sealed[sealNonceSize:], aad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// currentSealer returns the sealer for new segments, nil if encryption is off.
+func (o *options) currentSealer() (*sealer, error) {
+	if o.keys == nil {
+		return nil, nil
+	}
+	id := o.keys.CurrentKeyID()
+	key, err := o.keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the current encryption key: %w", err)
+	}
+	return newSealer(id, key)
+}
+
+// unlock sets the sealer of an encrypted segment whose header was read.
+func (o *options) unlock(s *Segment) error {
+	if !s.encrypted {
+		return nil
+	}
+	if o.keys == nil {
+		return fmt.Errorf("%w: %s", errNoKeyProvider, s.filePath)
+	}
+	key, err := o.keys.Key(s.keyID)
+	if err != nil {
+		return fmt.Errorf("cannot get encryption key of %s: %w", s.filePath, err)
+	}
+	s.sealer, err = newSealer(s.keyID, key)
+	return err
+}
+
+// open decrypts the key and the value of a sealed record with s. The entry
+// keeps s, so it is encrypted again when encoded.
+func (e *entry) open(s *sealer) error {
+	if e.sealed == "" {
+		return nil
+	}
+	if s == nil {
+		return errNoKeyProvider
+	}
+	data := []byte(e.sealed)
+	kl := int(binary.LittleEndian.Uint32(data[4:]))
+	vl := int(binary.LittleEndian.Uint32(data[8:]))
+	pos := len(data) - kl - vl
+	plaintext, err := s.open(data[pos:], data[:pos])
+	if err != nil {
+		return err
+	}
+	e.key = string(plaintext[:kl])
+	if data[12]&flagCompressed != 0 {
+		e.stored = string(plaintext[kl:])
+	} else {
+		e.value = string(plaintext[kl:])
+	}
+	e.sealed = ""
+	e.sealer = s
+	return nil
+}
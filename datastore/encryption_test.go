@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys, err := ParseKeyRing("1:000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(opts ...Option) (*Db, error) {
+		return NewDb(dir, 1000, append([]Option{WithCompactionInterval(0)}, opts...)...)
+	}
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for key, want := range map[string]string{"email": "user@example.com", "name": "John Doe", "doc": strings.Repeat("secret ", 20)} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value of %s returned (%v)", key, err)
+			}
+		}
+		if n, err := db.GetInt64("visits"); err != nil || n != 3 {
+			t.Errorf("Expected 3 visits, got %d (%v)", n, err)
+		}
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	}
+	plaintextLeft := func(t *testing.T) {
+		t.Helper()
+		paths, _, err := findSegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			data, _ := os.ReadFile(path)
+			for _, s := range []string{"email", "example.com", "John", "secret"} {
+				if bytes.Contains(data, []byte(s)) {
+					t.Errorf("%s contains %q in plain text", path, s)
+				}
+			}
+		}
+	}
+
+	t.Run("encrypted writes", func(t *testing.T) {
+		db, err := open(WithEncryption(keys), WithCompression(FlateCodec, 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Put("email", "user@example.com")
+		db.Put("deleted", "value")
+		b := new(Batch)
+		b.Put("name", "John Doe")
+		b.Delete("deleted")
+		if err := db.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("doc", strings.Repeat("secret ", 20))
+		for i := 0; i < 3; i++ {
+			db.Increment("visits", 1)
+		}
+		check(t, db)
+		r, err := db.GetReader("email")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if value, _ := ioutil.ReadAll(r); string(value) != "user@example.com" {
+			t.Errorf("Bad streamed value %q", value)
+		}
+		if s := db.getLastSegment(); !s.encrypted || s.keyID != 1 {
+			t.Errorf("Expected a segment encrypted with key 1, got %v %d", s.encrypted, s.keyID)
+		}
+		plaintextLeft(t)
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		db, err := open(WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("key required", func(t *testing.T) {
+		if _, err := open(); !errors.Is(err, errNoKeyProvider) {
+			t.Errorf("Expected errNoKeyProvider, got %v", err)
+		}
+		other, _ := ParseKeyRing("2:0f0e0d0c0b0a09080706050403020100")
+		if _, err := open(WithEncryption(other)); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Expected ErrUnknownKey, got %v", err)
+		}
+		wrong, _ := ParseKeyRing("1:0f0e0d0c0b0a09080706050403020100")
+		if _, err := open(WithEncryption(wrong)); !errors.Is(err, errDecrypt) {
+			t.Errorf("Expected errDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		db, err := open(WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := db.getLastSegment()
+		torn := entry{key: "torn", value: "value", checksum: s.checksum, sealer: s.sealer}
+		path := s.filePath
+		db.Close()
+
+		info, _ := os.Stat(path)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := torn.Encode()
+		f.Write(data[:len(data)-3])
+		f.Close()
+
+		db, err = open(WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if stat, _ := os.Stat(path); stat.Size() != info.Size() {
+			t.Errorf("Expected the segment to be truncated to %d, got %d", info.Size(), stat.Size())
+		}
+		check(t, db)
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		newKey := []byte("0123456789abcdef0123456789abcdef")
+		keys.Add(2, newKey)
+		db, err := open(WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.runInPutRoutine(db.rotate); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range db.getSegments() {
+			if s.keyID != 2 {
+				t.Errorf("Expected %s to use key 2, got %d", s.filePath, s.keyID)
+			}
+		}
+		db.Close()
+		plaintextLeft(t)
+
+		rotated := new(KeyRing)
+		rotated.Add(2, newKey)
+		db, err = open(WithEncryption(rotated))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("inspection", func(t *testing.T) {
+		paths, _, err := findSegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var withKey, withoutKey []Record
+		for _, path := range paths {
+			err = ScanSegment(path, func(r Record) error {
+				withoutKey = append(withoutKey, r)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ScanSegment(path, func(r Record) error {
+				withKey = append(withKey, r)
+				return nil
+			}, WithEncryption(keys))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(withKey) == 0 || len(withKey) != len(withoutKey) {
+			t.Fatalf("Expected the same records with and without the key, got %d and %d", len(withKey), len(withoutKey))
+		}
+		for i := range withKey {
+			if withKey[i].Err != nil || withoutKey[i].Err != nil || !withKey[i].Encrypted {
+				t.Errorf("Unexpected record %+v", withKey[i])
+			}
+			if withoutKey[i].Key != "" || withKey[i].Key == "" {
+				t.Errorf("Expected the key only with the key provider, got %q and %q", withoutKey[i].Key, withKey[i].Key)
+			}
+		}
+	})
+}
+
+func TestParseKeyRing(t *testing.T) {
+	r, err := ParseKeyRing("# old key\n1:000102030405060708090a0b0c0d0e0f\n\n2:101112131415161718191a1b1c1d1e1f\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CurrentKeyID() != 2 {
+		t.Errorf("Expected current key 2, got %d", r.CurrentKeyID())
+	}
+	if key, err := r.Key(1); err != nil || key[15] != 0x0f {
+		t.Errorf("Bad key 1 returned (%v)", err)
+	}
+	if _, err := r.Key(3); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+
+	for _, s := range []string{"", "1", "x:00", "1:zz", "1:0001"} {
+		if _, err := ParseKeyRing(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
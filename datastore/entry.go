@@ -3,96 +3,317 @@ package datastore
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 )
 
+// Record kinds stored right after the size header of every entry. The kind is
+// followed by the ValueType of the record.
+const (
+	kindValue byte = iota
+	kindTombstone
+	kindBatch
+)
+
+// Flags in the kind byte mark optional fields stored after the header in this
+// order: flagSeq a u64 sequence number, flagExpiry an i64 expiry time in Unix
+// nanoseconds. Records written before these fields were introduced have none.
+// flagCompressed marks a compressed value, flagSealed an encrypted key and
+// value.
+const (
+	flagSeq        byte = 0x80
+	flagExpiry     byte = 0x40
+	flagCompressed byte = 0x20
+	flagSealed     byte = 0x10
+	kindMask            = ^(flagSeq | flagExpiry | flagCompressed | flagSealed)
+)
+
+const (
+	headerSize = 14
+	seqSize    = 8
+	expirySize = 8
+)
+
+// Records written by the first version of the store have a shorter header
+//
+//	size u32 | kl u32 | vl u32 | key | value | sha1 of everything before
+//
+// without the kind and the value type, they are string values. Such records
+// are only found in segments without a segment header and are recognized by
+// their size, which exceeds the key and the value by 32 bytes. Records of the
+// current layout exceed them by 34, 42 or 50 bytes with SHA1 and by 18, 26 or
+// 34 bytes with CRC32C, so they are never taken for legacy ones.
+const legacyHeaderSize = 12
+
+// isLegacyRecord reports whether header, the first headerSize bytes of a
+// record or all of them if the record is shorter, starts a record of the
+// legacy layout.
+func isLegacyRecord(header []byte) bool {
+	if len(header) < legacyHeaderSize {
+		return false
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	vl := int64(binary.LittleEndian.Uint32(header[8:]))
+	return size == kl+vl+legacyHeaderSize+int64(ChecksumSHA1.size())
+}
+
+// recordFlags returns the flags of the record starting with header, none for
+// a legacy record.
+func recordFlags(header []byte) byte {
+	if isLegacyRecord(header) {
+		return 0
+	}
+	return header[12] &^ kindMask
+}
+
+var errBadChecksum = errors.New("checksum is incorrect")
+
 type entry struct {
 	key, value string
-	sum        []byte
+	kind       byte
+	valueType  ValueType
+	// seq is the sequence number of the record, zero if it has none.
+	seq uint64
+	// expiresAt is the expiry time in Unix nanoseconds, zero if the record
+	// does not expire.
+	expiresAt int64
+	// stored is the compressed form of value written to the segment, empty if
+	// the value is stored as is.
+	stored string
+	// sealer encrypts the record when it is written to an encrypted segment.
+	// sealed holds a record read from such a segment until open decrypts it.
+	sealer *sealer
+	sealed string
+	// checksum is the algorithm of the segment the record belongs to.
+	checksum Checksum
+	sum      []byte
 }
 
 func getLength(key string, value string) int64 {
-	return int64(len(key) + len(value) + 12)
+	return int64(len(key) + len(value) + headerSize)
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
-	vl := len(e.value)
-	size := kl + vl + 32
+	value := e.storedValue()
+	vl := len(value)
+	if e.sealer != nil {
+		vl += sealOverhead
+	}
+	size := int(e.encodedSize())
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
-	copy(res[12:], e.key)
-	copy(res[kl+12:], e.value)
-	data := make([]byte, size-20)
-	copy(data, res[:size-19])
-	sum := sha1.Sum(data)
-	copy(res[size-20:], sum[:])
+	res[12] = e.kind
+	res[13] = byte(e.valueType)
+	pos := headerSize
+	if e.seq != 0 {
+		res[12] |= flagSeq
+		binary.LittleEndian.PutUint64(res[pos:], e.seq)
+		pos += seqSize
+	}
+	if e.expiresAt != 0 {
+		res[12] |= flagExpiry
+		binary.LittleEndian.PutUint64(res[pos:], uint64(e.expiresAt))
+		pos += expirySize
+	}
+	if e.stored != "" {
+		res[12] |= flagCompressed
+	}
+	if e.sealer != nil {
+		res[12] |= flagSealed
+		plaintext := make([]byte, 0, kl+len(value))
+		plaintext = append(append(plaintext, e.key...), value...)
+		copy(res[pos:], e.sealer.seal(plaintext, res[:pos]))
+	} else {
+		copy(res[pos:], e.key)
+		copy(res[pos+kl:], value)
+	}
+	sumSize := e.checksum.size()
+	copy(res[size-sumSize:], e.checksum.sum(res[:size-sumSize]))
 
 	return res
 }
 
+// recordSize returns the full size of the record starting with header.
+func recordSize(header []byte, c Checksum) int64 {
+	keySize := int64(binary.LittleEndian.Uint32(header[4:]))
+	valSize := int64(binary.LittleEndian.Uint32(header[8:]))
+	if isLegacyRecord(header) {
+		return keySize + valSize + legacyHeaderSize + int64(c.size())
+	}
+	size := keySize + valSize + headerSize + int64(c.size())
+	if header[12]&flagSeq != 0 {
+		size += seqSize
+	}
+	if header[12]&flagExpiry != 0 {
+		size += expirySize
+	}
+	return size
+}
+
 func (e *entry) getLength() int64 {
-	return getLength(e.key, e.value)
+	return getLength(e.key, e.storedValue())
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	vl := binary.LittleEndian.Uint32(input[8:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[12:kl+12])
-	e.key = string(keyBuf)
+// storedValue returns the bytes written in place of the value.
+func (e *entry) storedValue() string {
+	if e.stored != "" {
+		return e.stored
+	}
+	return e.value
+}
+
+// encodedSize returns the number of bytes Encode produces, or the size of the
+// record if it was read and is still sealed.
+func (e *entry) encodedSize() int64 {
+	if e.sealed != "" {
+		return int64(len(e.sealed) + e.checksum.size())
+	}
+	size := int64(len(e.key)+len(e.storedValue())) + headerSize + int64(e.checksum.size())
+	if e.seq != 0 {
+		size += seqSize
+	}
+	if e.expiresAt != 0 {
+		size += expirySize
+	}
+	if e.sealer != nil {
+		size += sealOverhead
+	}
+	return size
+}
+
+func (e *entry) isTombstone() bool {
+	return e.kind == kindTombstone
+}
+
+// isExpired reports whether the record has an expiry time not after now.
+func (e *entry) isExpired(now time.Time) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now.UnixNano()
+}
 
+// Decode decodes a record. The value of a compressed record is left empty
+// until unpack is called, the key and the value of a sealed record until open
+// is called.
+func (e *entry) Decode(input []byte) {
+	pos, vl := e.decodePrefix(input)
+	flags := recordFlags(input)
+	e.sealed = ""
+	if flags&flagSealed != 0 {
+		e.value, e.stored = "", ""
+		e.sealed = string(input[:pos+vl])
+		e.sum = append([]byte(nil), input[pos+vl:]...)
+		return
+	}
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
-	e.sum = make([]byte, 20)
-	copy(e.sum, input[kl+vl+12:])
+	copy(valBuf, input[pos:pos+vl])
+	e.value, e.stored = string(valBuf), ""
+	if flags&flagCompressed != 0 {
+		e.value, e.stored = "", string(valBuf)
+	}
+	e.sum = append([]byte(nil), input[pos+vl:]...)
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(12)
+// unpack decompresses the value of a compressed record. The compressed form
+// is kept, so the record can be written again without compressing it.
+func (e *entry) unpack() error {
+	if e.stored == "" {
+		return nil
+	}
+	value, err := decompress(e.stored)
 	if err != nil {
-		return "", err
+		return err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	valSize := int(binary.LittleEndian.Uint32(header[8:]))
+	e.value = value
+	return nil
+}
 
-	data, err := in.Peek(12 + keySize + valSize)
-	if err != nil {
-		return "", err
+// decodePrefix decodes everything that precedes the value of a record and
+// returns the offset and the length of the value. For a sealed record it stops
+// before the key and returns the offset and the length of the sealed bytes.
+func (e *entry) decodePrefix(input []byte) (int, int) {
+	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	vl := int(binary.LittleEndian.Uint32(input[8:]))
+	e.seq, e.expiresAt, e.key = 0, 0, ""
+	if isLegacyRecord(input) {
+		e.kind, e.valueType = kindValue, TypeString
+		e.key = string(input[legacyHeaderSize : legacyHeaderSize+kl])
+		return legacyHeaderSize + kl, vl
+	}
+	e.kind = input[12] & kindMask
+	e.valueType = ValueType(input[13])
+	pos := headerSize
+	if input[12]&flagSeq != 0 {
+		e.seq = binary.LittleEndian.Uint64(input[pos:])
+		pos += seqSize
 	}
+	if input[12]&flagExpiry != 0 {
+		e.expiresAt = int64(binary.LittleEndian.Uint64(input[pos:]))
+		pos += expirySize
+	}
+	if input[12]&flagSealed != 0 {
+		return pos, kl + vl
+	}
+	keyBuf := make([]byte, kl)
+	copy(keyBuf, input[pos:pos+kl])
+	e.key = string(keyBuf)
+	return pos + kl, vl
+}
 
-	_, err = in.Discard(12 + keySize)
+// readEntry reads a whole record protected by checksum c from in, verifies it
+// and decompresses its value.
+func readEntry(in *bufio.Reader, c Checksum) (entry, error) {
+	e, err := readRecord(in, c)
 	if err != nil {
-		return "", err
+		return e, err
 	}
+	return e, e.unpack()
+}
 
-	valueData, err := in.Peek(valSize)
+// readRecord is readEntry that leaves a compressed value packed.
+func readRecord(in *bufio.Reader, c Checksum) (entry, error) {
+	var e entry
+	header, err := in.Peek(headerSize)
 	if err != nil {
-		return "", err
-	}
-	if len(valueData) != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", len(valueData), valSize)
+		return e, err
 	}
+	size := recordSize(header, c)
 
-	_, err = in.Discard(valSize)
+	data := make([]byte, size)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return e, fmt.Errorf("can't read record bytes (read %d, expected %d): %w", n, size, err)
+	}
+	return decodeRecord(data, c)
+}
+
+// decodeRecord verifies the checksum c of a whole record and decodes it.
+func decodeRecord(data []byte, c Checksum) (entry, error) {
+	var e entry
+	sumSize := c.size()
+	if !bytes.Equal(data[len(data)-sumSize:], c.sum(data[:len(data)-sumSize])) {
+		return e, errBadChecksum
 	}
 
-	sum, err := in.Peek(20)
+	e.Decode(data)
+	e.checksum = c
+	return e, nil
+}
+
+// readValue reads a record protected by checksum c from in and returns its
+// value. Tombstones are reported as ErrNotFound.
+func readValue(in *bufio.Reader, c Checksum) (string, error) {
+	e, err := readEntry(in, c)
 	if err != nil {
 		return "", err
 	}
-	realSum := sha1.Sum(data)
-	if bytes.Compare(sum, realSum[:]) != 0 {
-		return "", errors.New("SHA1 Sum is incorrect")
+	if e.isTombstone() {
+		return "", ErrNotFound
 	}
-
-	return string(valueData), nil
+	return e.value, nil
 }
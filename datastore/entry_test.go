@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value", nil}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,9 +20,9 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value", nil}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)), ChecksumSHA1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,12 +32,85 @@ func TestReadValue(t *testing.T) {
 }
 
 func TestCheckSum(t *testing.T) {
-	e := entry{"key", "test-value", nil}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	newEntry := entry{}
 	newEntry.Decode(data)
 
-	if bytes.Compare(newEntry.sum, []byte{144, 131, 170, 173, 93, 163, 160, 73, 213, 155, 208, 224, 74, 82, 135, 153, 183, 128, 175, 214}) != 0 {
+	if bytes.Compare(newEntry.sum, []byte{201, 182, 122, 151, 107, 117, 9, 46, 240, 248, 101, 161, 226, 32, 184, 122, 138, 90, 254, 15}) != 0 {
 		t.Errorf("Check sum calculated incorrectly")
 	}
 }
+
+// legacyRecord encodes a record in the layout of the first version of the
+// store.
+func legacyRecord(key, value string) []byte {
+	size := len(key) + len(value) + 32
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(res[8:], uint32(len(value)))
+	copy(res[12:], key)
+	copy(res[12+len(key):], value)
+	sum := sha1.Sum(res[:size-20])
+	copy(res[size-20:], sum[:])
+	return res
+}
+
+func TestEntry_Legacy(t *testing.T) {
+	data := legacyRecord("key", "test-value")
+	if recordSize(data, ChecksumSHA1) != int64(len(data)) {
+		t.Errorf("Expected record size %d, got %d", len(data), recordSize(data, ChecksumSHA1))
+	}
+	e, err := readEntry(bufio.NewReader(bytes.NewReader(data)), ChecksumSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.key != "key" || e.value != "test-value" || e.kind != kindValue || e.valueType != TypeString || e.seq != 0 {
+		t.Errorf("Unexpected legacy entry %+v", e)
+	}
+	// The checksum of the first version of the store.
+	if bytes.Compare(e.sum, []byte{144, 131, 170, 173, 93, 163, 160, 73, 213, 155, 208, 224, 74, 82, 135, 153, 183, 128, 175, 214}) != 0 {
+		t.Errorf("Check sum calculated incorrectly")
+	}
+	for _, current := range []entry{
+		{key: "key", value: "test-value"},
+		{key: "key", value: "test-value", seq: 1, expiresAt: 1},
+		{key: "key", value: "test-value", checksum: ChecksumCRC32C},
+		{key: "", kind: kindTombstone},
+	} {
+		if isLegacyRecord(current.Encode()) {
+			t.Errorf("Record %+v taken for a legacy one", current)
+		}
+	}
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", kind: kindTombstone}
+	data := e.Encode()
+
+	var decoded entry
+	decoded.Decode(data)
+	if !decoded.isTombstone() {
+		t.Error("tombstone flag is lost")
+	}
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(data)), ChecksumSHA1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestEntry_CRC32C(t *testing.T) {
+	e := entry{key: "key", value: "test-value", checksum: ChecksumCRC32C}
+	data := e.Encode()
+	if len(data) != int(e.encodedSize()) || int(e.encodedSize()) != headerSize+len("keytest-value")+4 {
+		t.Errorf("Unexpected record size %d", len(data))
+	}
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)), ChecksumCRC32C)
+	if err != nil || v != "test-value" {
+		t.Errorf("Got bad value [%s] (%v)", v, err)
+	}
+	data[len(data)-6] ^= 0xff
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(data)), ChecksumCRC32C); err != errBadChecksum {
+		t.Errorf("Expected errBadChecksum, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Segment files start with a header
+//
+//	magic [4]byte | format version u8 | checksum u8 | reserved u16
+//
+// followed by records. Encrypted segments use format version 2 whose header
+// continues with
+//
+//	cipher u8 | reserved [3]byte | key id u32
+//
+// Files written before the header was introduced start right with the first
+// record and use SHA1 checksums. The magic read as the size of a record would
+// exceed any sensible segment size, so the layouts cannot be confused.
+const (
+	segmentMagic               = "KVSG"
+	segmentFormatVersion       = 1
+	encryptedFormatVersion     = 2
+	segmentHeaderSize          = 8
+	encryptedSegmentHeaderSize = 16
+)
+
+var errBadSegmentHeader = errors.New("segment header is invalid")
+
+// encodeSegmentHeader returns the header of a segment protected by checksum c
+// and encrypted by sl unless it is nil.
+func encodeSegmentHeader(c Checksum, sl *sealer) []byte {
+	if sl == nil {
+		header := make([]byte, segmentHeaderSize)
+		copy(header, segmentMagic)
+		header[4] = segmentFormatVersion
+		header[5] = byte(c)
+		return header
+	}
+	header := make([]byte, encryptedSegmentHeaderSize)
+	copy(header, segmentMagic)
+	header[4] = encryptedFormatVersion
+	header[5] = byte(c)
+	header[8] = cipherAESGCM
+	binary.LittleEndian.PutUint32(header[12:], sl.keyID)
+	return header
+}
+
+// newSegment returns an empty segment at filePath in the format configured by
+// o together with the header to write to its file.
+func (o *options) newSegment(filePath string) (*Segment, []byte, error) {
+	sl, err := o.currentSealer()
+	if err != nil {
+		return nil, nil, err
+	}
+	header := encodeSegmentHeader(o.checksum, sl)
+	s := &Segment{
+		outOffset: int64(len(header)),
+		start:     int64(len(header)),
+		checksum:  o.checksum,
+		filePath:  filePath,
+		index:     make(hashIndex),
+		sealer:    sl,
+		mmap:      o.mmap,
+	}
+	if sl != nil {
+		s.encrypted, s.keyID = true, sl.keyID
+	}
+	return s, header, nil
+}
+
+// readHeader reads the segment header and sets the checksum algorithm, the
+// encryption key ID and the offset of the first record of the segment.
+func (s *Segment) readHeader() error {
+	f, err := os.Open(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, encryptedSegmentHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if n < len(segmentMagic) || !bytes.Equal(header[:len(segmentMagic)], []byte(segmentMagic)) {
+		s.checksum = ChecksumSHA1
+		s.start = 0
+		s.outOffset = 0
+		return nil
+	}
+	size := segmentHeaderSize
+	switch header[4] {
+	case segmentFormatVersion:
+	case encryptedFormatVersion:
+		size = encryptedSegmentHeaderSize
+	default:
+		return fmt.Errorf("%w: %s has unsupported format version %d", errBadSegmentHeader, s.filePath, header[4])
+	}
+	if n < size {
+		return fmt.Errorf("%w: %s has only %d bytes", errBadSegmentHeader, s.filePath, n)
+	}
+	c := Checksum(header[5])
+	if !c.valid() {
+		return fmt.Errorf("%w: %s uses unknown checksum %d", errBadSegmentHeader, s.filePath, header[5])
+	}
+	s.encrypted = size == encryptedSegmentHeaderSize
+	if s.encrypted {
+		if header[8] != cipherAESGCM {
+			return fmt.Errorf("%w: %s uses unknown cipher %d", errBadSegmentHeader, s.filePath, header[8])
+		}
+		s.keyID = binary.LittleEndian.Uint32(header[12:])
+	}
+	s.checksum = c
+	s.start = int64(size)
+	s.outOffset = int64(size)
+	return nil
+}
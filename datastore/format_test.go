@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_SegmentFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A segment written by the first version of the store.
+	legacy := append(legacyRecord("key1", "value1"), legacyRecord("key2", "value2")...)
+	if err := os.WriteFile(filepath.Join(dir, outFileName+"0"), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("headerless segments are readable", func(t *testing.T) {
+		db, err := NewDb(dir, 1000, WithCompactionInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if s := db.getLastSegment(); s.checksum != ChecksumSHA1 || s.start != 0 {
+			t.Errorf("Expected a headerless SHA1 segment, got %s starting at %d", s.checksum, s.start)
+		}
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		b := new(Batch)
+		b.Put("key4", "value4")
+		if err := db.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("new segments have a header", func(t *testing.T) {
+		db, err := NewDb(dir, 1000, WithCompactionInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, want := range map[string]string{"key1": "value1", "key2": "value2", "key3": "value3", "key4": "value4"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", want, value, err)
+			}
+		}
+
+		if _, err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range db.getSegments() {
+			checked := &Segment{filePath: s.filePath}
+			if err := checked.readHeader(); err != nil {
+				t.Fatal(err)
+			}
+			if checked.checksum != ChecksumCRC32C || checked.start != segmentHeaderSize {
+				t.Errorf("Expected a CRC32C segment header in %s, got %s starting at %d", s.filePath, checked.checksum, checked.start)
+			}
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value1" {
+			t.Errorf("Bad value returned expected value1, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("configured checksum", func(t *testing.T) {
+		db, err := NewDb(dir, 1000, WithCompactionInterval(0), WithChecksum(ChecksumSHA1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Put("key5", "value5")
+		if err := db.runInPutRoutine(db.rotate); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("key5", "value5")
+		if s := db.getLastSegment(); s.checksum != ChecksumSHA1 || s.start != segmentHeaderSize {
+			t.Errorf("Expected a SHA1 segment with a header, got %s starting at %d", s.checksum, s.start)
+		}
+		if value, err := db.Get("key5"); err != nil || value != "value5" {
+			t.Errorf("Bad value returned expected value5, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		m, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(m.paths[0], os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{segmentFormatVersion + 1}, 4)
+		f.Close()
+		if _, err := NewDb(dir, 1000); !errors.Is(err, errBadSegmentHeader) {
+			t.Errorf("Expected errBadSegmentHeader, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A hint file stores the index of a sealed segment next to it so that the
+// index can be loaded on startup without reading values. It holds one entry
+// per key
+//
+//	kl u32 | offset u64 | length u32 | expires at i64 | sl u8 | key | record checksum
+//
+// sorted by offset and followed by a trailer
+//
+//	segment size u64 | records u32 | entries u32 | sha1 of everything before
+//
+// A hint that is missing, fails its checksum or does not match the size of its
+// segment is ignored and the segment is scanned instead. The hint of an
+// encrypted segment is sealed as a whole with the key of the segment.
+const (
+	hintSuffix      = ".hint"
+	hintEntryHeader = 25
+	hintTrailerSize = 16 + sha1.Size
+)
+
+var errBadHint = errors.New("hint file is invalid")
+
+// hintRecord describes the newest record of a key in a segment.
+type hintRecord struct {
+	offset    int64
+	length    uint32
+	expiresAt int64
+	sum       []byte
+}
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+// addHint remembers the record of key at offset for the segment hint. It is
+// called by the goroutine that owns the segment while it is written.
+func (s *Segment) addHint(key string, offset int64, length int64, expiresAt int64, sum []byte) {
+	if s.hints == nil {
+		s.hints = make(map[string]hintRecord)
+	}
+	s.hints[key] = hintRecord{
+		offset:    offset,
+		length:    uint32(length),
+		expiresAt: expiresAt,
+		sum:       append([]byte(nil), sum...),
+	}
+}
+
+// addRecordHint remembers the entry encoded as record for the segment hint.
+func (s *Segment) addRecordHint(e *entry, offset int64, record []byte) {
+	s.addHint(e.key, offset, int64(len(record)), e.expiresAt, record[len(record)-e.checksum.size():])
+}
+
+// hintExpiries returns expiry times of keys whose newest record in the
+// segment expires.
+func (s *Segment) hintExpiries() map[string]int64 {
+	expiries := make(map[string]int64)
+	for key, h := range s.hints {
+		if h.expiresAt != 0 {
+			expiries[key] = h.expiresAt
+		}
+	}
+	return expiries
+}
+
+// writeHint stores the collected hints of a segment that will not be written
+// anymore.
+func (s *Segment) writeHint(mode os.FileMode) error {
+	s.mu.RLock()
+	records := s.records
+	s.mu.RUnlock()
+	data := encodeHint(s.hints, s.outOffset, records)
+	if s.sealer != nil {
+		data = s.sealer.seal(data, nil)
+	}
+	return writeFileAtomically(hintPath(s.filePath), data, mode)
+}
+
+func encodeHint(hints map[string]hintRecord, segmentSize int64, records int) []byte {
+	keys := make([]string, 0, len(hints))
+	for key := range hints {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return hints[keys[i]].offset < hints[keys[j]].offset
+	})
+
+	var buf bytes.Buffer
+	header := make([]byte, hintEntryHeader)
+	for _, key := range keys {
+		h := hints[key]
+		binary.LittleEndian.PutUint32(header, uint32(len(key)))
+		binary.LittleEndian.PutUint64(header[4:], uint64(h.offset))
+		binary.LittleEndian.PutUint32(header[12:], h.length)
+		binary.LittleEndian.PutUint64(header[16:], uint64(h.expiresAt))
+		header[24] = byte(len(h.sum))
+		buf.Write(header)
+		buf.WriteString(key)
+		buf.Write(h.sum)
+	}
+
+	trailer := make([]byte, hintTrailerSize-sha1.Size)
+	binary.LittleEndian.PutUint64(trailer, uint64(segmentSize))
+	binary.LittleEndian.PutUint32(trailer[8:], uint32(records))
+	binary.LittleEndian.PutUint32(trailer[12:], uint32(len(keys)))
+	buf.Write(trailer)
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// loadHint fills the segment index from its hint file and returns expiry
+// times of keys whose newest record in the segment expires.
+func (s *Segment) loadHint() (map[string]int64, error) {
+	index, segmentSize, records, expiries, err := s.readHint()
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	s.outOffset = segmentSize
+	s.records = records
+	return expiries, nil
+}
+
+// readHintExpiries reads expiry times of keys whose newest record in the
+// segment expires from the hint file.
+func (s *Segment) readHintExpiries() (map[string]int64, error) {
+	_, _, _, expiries, err := s.readHint()
+	return expiries, err
+}
+
+// readHint decodes the hint file of the segment returning the index, the size
+// of the segment, the number of its records and the expiry times.
+func (s *Segment) readHint() (hashIndex, int64, int, map[string]int64, error) {
+	data, err := os.ReadFile(hintPath(s.filePath))
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	if s.sealer != nil {
+		if data, err = s.sealer.open(data, nil); err != nil {
+			return nil, 0, 0, nil, fmt.Errorf("%w: %s", errBadHint, err)
+		}
+	}
+	stat, err := os.Stat(s.filePath)
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+
+	if len(data) < hintTrailerSize {
+		return nil, 0, 0, nil, errBadHint
+	}
+	body := data[:len(data)-sha1.Size]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, 0, 0, nil, fmt.Errorf("%w: bad checksum", errBadHint)
+	}
+	trailer := body[len(body)-(hintTrailerSize-sha1.Size):]
+	segmentSize := int64(binary.LittleEndian.Uint64(trailer))
+	records := int(binary.LittleEndian.Uint32(trailer[8:]))
+	count := int(binary.LittleEndian.Uint32(trailer[12:]))
+	if segmentSize != stat.Size() {
+		return nil, 0, 0, nil, fmt.Errorf("%w: segment has %d bytes, hint expects %d", errBadHint, stat.Size(), segmentSize)
+	}
+
+	index := make(hashIndex, count)
+	expiries := make(map[string]int64)
+	entries := body[:len(body)-len(trailer)]
+	for len(entries) > 0 {
+		if len(entries) < hintEntryHeader {
+			return nil, 0, 0, nil, fmt.Errorf("%w: truncated entry", errBadHint)
+		}
+		kl := int(binary.LittleEndian.Uint32(entries))
+		offset := int64(binary.LittleEndian.Uint64(entries[4:]))
+		length := int64(binary.LittleEndian.Uint32(entries[12:]))
+		expiresAt := int64(binary.LittleEndian.Uint64(entries[16:]))
+		sl := int(entries[24])
+		if len(entries) < hintEntryHeader+kl+sl || offset < 0 || offset+length > segmentSize {
+			return nil, 0, 0, nil, fmt.Errorf("%w: bad entry", errBadHint)
+		}
+		key := string(entries[hintEntryHeader : hintEntryHeader+kl])
+		index[key] = offset
+		if expiresAt != 0 {
+			expiries[key] = expiresAt
+		}
+		entries = entries[hintEntryHeader+kl+sl:]
+	}
+	if len(index) != count {
+		return nil, 0, 0, nil, fmt.Errorf("%w: expected %d entries, got %d", errBadHint, count, len(index))
+	}
+	return index, segmentSize, records, expiries, nil
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Hints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 90, WithCompactionThreshold(100), WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i))
+	}
+	db.Delete("key3")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"key0": "value4", "key1": "value5", "key2": "value2"}
+	open := func(t *testing.T) (*Db, RecoveryReport) {
+		var report RecoveryReport
+		db, err := NewDb(dir, 90, WithCompactionThreshold(100), WithCompactionInterval(0),
+			WithRecoveryHandler(func(r RecoveryReport) {
+				report = r
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range expected {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", want, value, err)
+			}
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if report.Records != 7 {
+			t.Errorf("Expected 7 records, got %d", report.Records)
+		}
+		return db, report
+	}
+
+	t.Run("sealed segments are loaded from hints", func(t *testing.T) {
+		db, report := open(t)
+		defer db.Close()
+		if report.Segments != 4 || report.HintedSegments != 3 {
+			t.Errorf("Unexpected recovery report %+v", report)
+		}
+	})
+
+	t.Run("invalid hints are ignored", func(t *testing.T) {
+		path := hintPath(filepath.Join(dir, outFileName+"0"))
+		f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{'X'}, 2)
+		f.Close()
+		if err := os.Remove(hintPath(filepath.Join(dir, outFileName+"1"))); err != nil {
+			t.Fatal(err)
+		}
+
+		db, report := open(t)
+		db.Close()
+		if report.HintedSegments != 1 {
+			t.Errorf("Expected 1 hinted segment, got %d", report.HintedSegments)
+		}
+
+		db, report = open(t)
+		defer db.Close()
+		if report.HintedSegments != 3 {
+			t.Errorf("Expected hints to be rewritten, got %d hinted segments", report.HintedSegments)
+		}
+	})
+
+	t.Run("hint of a changed segment is ignored", func(t *testing.T) {
+		f, err := os.OpenFile(filepath.Join(dir, outFileName+"2"), os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{'X'})
+		f.Close()
+
+		_, err = NewDb(dir, 90)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) || corruption.Offset != 80 {
+			t.Errorf("Expected the segment to be scanned and reported as corrupted, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+// Index maps the keys of a segment to the positions of their newest records.
+// The active segment always keeps a hashIndex in memory, sealed segments keep
+// one as well unless WithDiskIndex moves their indexes to disk. The index of a
+// sealed segment never changes and is safe for concurrent use.
+type Index interface {
+	// Get returns the position of the key, false if it is not indexed.
+	Get(key string) (position int64, ok bool, err error)
+	// Len returns the number of indexed keys.
+	Len() int
+	// Range calls fn for every key starting with prefix that is not less than
+	// from until fn returns an error, which Range returns. The order of keys
+	// depends on the implementation.
+	Range(prefix, from string, fn func(key string, position int64) error) error
+}
+
+// hashIndex is the in-memory Index.
+type hashIndex map[string]int64
+
+func (h hashIndex) Get(key string) (int64, bool, error) {
+	position, ok := h[key]
+	return position, ok, nil
+}
+
+func (h hashIndex) Len() int {
+	return len(h)
+}
+
+func (h hashIndex) Range(prefix, from string, fn func(key string, position int64) error) error {
+	for key, position := range h {
+		if key < from || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(key, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h hashIndex) clone() hashIndex {
+	c := make(hashIndex, len(h))
+	for key, position := range h {
+		c[key] = position
+	}
+	return c
+}
+
+// indexCursor walks the keys of an index in ascending order.
+type indexCursor interface {
+	// next returns the next key, false once the keys are exhausted.
+	next() (key string, position int64, ok bool, err error)
+}
+
+// sortedCursor walks sorted entries copied from a hashIndex.
+type sortedCursor struct {
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	key      string
+	position int64
+}
+
+func (c *sortedCursor) next() (string, int64, bool, error) {
+	if len(c.entries) == 0 {
+		return "", 0, false, nil
+	}
+	e := c.entries[0]
+	c.entries = c.entries[1:]
+	return e.key, e.position, true, nil
+}
+
+// newCursor returns a cursor over the keys of index starting with prefix that
+// are not less than from. Keys of a hashIndex are copied, so the index may
+// change once newCursor returns, but not while it runs.
+func newCursor(index Index, prefix, from string) indexCursor {
+	if from < prefix {
+		from = prefix
+	}
+	if d, ok := index.(*diskIndex); ok {
+		return d.cursor(prefix, from)
+	}
+	c := &sortedCursor{}
+	index.Range(prefix, from, func(key string, position int64) error {
+		c.entries = append(c.entries, indexEntry{key: key, position: position})
+		return nil
+	})
+	sort.Slice(c.entries, func(i, j int) bool {
+		return c.entries[i].key < c.entries[j].key
+	})
+	return c
+}
+
+// mergeCursor walks the distinct keys of several cursors in ascending order.
+// Cursors are given oldest first, of equal keys the one of the newest cursor
+// wins.
+type mergeCursor struct {
+	cursors []indexCursor
+	heads   []cursorHead
+	started bool
+}
+
+type cursorHead struct {
+	key      string
+	position int64
+	ok       bool
+}
+
+func newMergeCursor(cursors []indexCursor) *mergeCursor {
+	return &mergeCursor{cursors: cursors, heads: make([]cursorHead, len(cursors))}
+}
+
+func (m *mergeCursor) advance(i int) error {
+	var err error
+	h := &m.heads[i]
+	h.key, h.position, h.ok, err = m.cursors[i].next()
+	return err
+}
+
+// next returns the next key with the number of the newest cursor holding it
+// and the position of the key there, false once the keys are exhausted.
+func (m *mergeCursor) next() (key string, newest int, position int64, ok bool, err error) {
+	if !m.started {
+		for i := range m.cursors {
+			if err := m.advance(i); err != nil {
+				return "", 0, 0, false, err
+			}
+		}
+		m.started = true
+	}
+	newest = -1
+	for i, h := range m.heads {
+		if h.ok && (newest < 0 || h.key <= m.heads[newest].key) {
+			newest = i
+		}
+	}
+	if newest < 0 {
+		return "", 0, 0, false, nil
+	}
+	key, position = m.heads[newest].key, m.heads[newest].position
+	for i, h := range m.heads {
+		if h.ok && h.key == key {
+			if err := m.advance(i); err != nil {
+				return "", 0, 0, false, err
+			}
+		}
+	}
+	return key, newest, position, true, nil
+}
+
+// mergeIndexes calls fn for every distinct key of indexes in ascending order
+// with the number of the newest index holding the key and the position of the
+// key there, until fn returns an error. Indexes are given oldest first. Keys of
+// on-disk indexes are read block by block, so they are never all in memory.
+func mergeIndexes(indexes []Index, fn func(key string, newest int, position int64) error) error {
+	cursors := make([]indexCursor, len(indexes))
+	for i, index := range indexes {
+		cursors[i] = newCursor(index, "", "")
+	}
+	m := newMergeCursor(cursors)
+	for {
+		key, newest, position, ok, err := m.next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := fn(key, newest, position); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The functions in this file work directly on the files of a data directory
+// and are meant for offline inspection and repair. They must not be used on a
+// directory that is open by a Db. Encrypted records are decrypted when a key
+// provider is passed with WithEncryption, other options are ignored.
+
+// quarantineDir is the subdirectory of a data directory that receives records
+// removed by RepairSegment.
+const quarantineDir = "quarantine"
+
+// RecordKind tells what a record of a segment file stores.
+type RecordKind byte
+
+const (
+	RecordValue     = RecordKind(kindValue)
+	RecordTombstone = RecordKind(kindTombstone)
+	// RecordBatch is the header of a batch followed by its records.
+	RecordBatch = RecordKind(kindBatch)
+)
+
+func (k RecordKind) String() string {
+	switch k {
+	case RecordValue:
+		return "value"
+	case RecordTombstone:
+		return "tombstone"
+	case RecordBatch:
+		return "batch"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(k))
+	}
+}
+
+// Record is a record of a segment file reported by ScanSegment.
+type Record struct {
+	Offset int64
+	Size   int64
+	Kind   RecordKind
+	Key    string
+	Type   ValueType
+	// Value is the uncompressed value, Compressed tells whether it is stored
+	// compressed.
+	Value      []byte
+	Compressed bool
+	// Encrypted tells whether the record is stored encrypted. Its key and
+	// value are empty when no key provider was given.
+	Encrypted bool
+	Seq       uint64
+	// ExpiresAt is the expiry time in Unix nanoseconds, zero if the record
+	// does not expire.
+	ExpiresAt int64
+	// Err is set when the record fails its checksum, is cut short by the end
+	// of the file or its value cannot be decompressed. Other fields of such a
+	// record cannot be trusted.
+	Err error
+}
+
+// BatchSize returns the number of records following a batch header.
+func (r *Record) BatchSize() int {
+	if r.Kind != RecordBatch || len(r.Value) != 4 {
+		return 0
+	}
+	e := entry{value: string(r.Value)}
+	n, _ := e.batchCount()
+	return n
+}
+
+// TypedValue returns the value of a record as a string, an int64 or a []byte
+// depending on Type.
+func (r *Record) TypedValue() (interface{}, error) {
+	e := entry{value: string(r.Value), valueType: r.Type}
+	return e.typedValue()
+}
+
+// SegmentInfo describes a segment file found by ListSegments.
+type SegmentInfo struct {
+	Path     string
+	Size     int64
+	Checksum Checksum
+	// Listed is false for files missing from the manifest, which are leftovers
+	// deleted by the next Open.
+	Listed bool
+	Active bool
+	// Records counts readable records of keys, batch headers are not counted.
+	Records int
+	// Keys is the number of distinct keys in the segment.
+	Keys int
+	// Corrupted counts records that fail their checksum including a torn tail.
+	Corrupted int
+	// GarbageRatio is the share of records that are shadowed by newer ones,
+	// deleted or expired. It is zero for segments that are not listed.
+	// Keys and GarbageRatio of encrypted segments need the key provider.
+	GarbageRatio float64
+	// KeyID is the ID of the key of an encrypted segment.
+	Encrypted bool
+	KeyID     uint32
+}
+
+// ListSegments describes all segment files of dir, the listed ones first in
+// the order of the manifest.
+func ListSegments(dir string, opts ...Option) ([]SegmentInfo, error) {
+	o := inspectOptions(opts)
+	paths, _, err := findSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(dir)
+	live := m.paths
+	if os.IsNotExist(err) {
+		live = paths
+	} else if err != nil {
+		return nil, err
+	}
+	isLive := make(map[string]bool, len(live))
+	for _, path := range live {
+		isLive[path] = true
+	}
+	ordered := append([]string(nil), live...)
+	for _, path := range paths {
+		if !isLive[path] {
+			ordered = append(ordered, path)
+		}
+	}
+
+	type newest struct {
+		segment int
+		live    bool
+	}
+	latest := make(map[string]newest)
+	now := time.Now().UnixNano()
+	infos := make([]SegmentInfo, len(ordered))
+	for i, path := range ordered {
+		info := &infos[i]
+		info.Path = path
+		info.Listed = isLive[path]
+		info.Active = info.Listed && path == live[len(live)-1]
+		keys := make(map[string]struct{})
+		s, err := scanSegment(path, &o, func(r Record, _ []byte) error {
+			if r.Err != nil {
+				info.Corrupted++
+				return nil
+			}
+			if r.Kind == RecordBatch {
+				return nil
+			}
+			info.Records++
+			keys[r.Key] = struct{}{}
+			if info.Listed {
+				alive := r.Kind != RecordTombstone && (r.ExpiresAt == 0 || r.ExpiresAt > now)
+				latest[r.Key] = newest{segment: i, live: alive}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		info.Size = s.outOffset
+		info.Checksum = s.checksum
+		info.Encrypted = s.encrypted
+		info.KeyID = s.keyID
+		info.Keys = len(keys)
+	}
+
+	liveRecords := make([]int, len(infos))
+	for _, n := range latest {
+		if n.live {
+			liveRecords[n.segment]++
+		}
+	}
+	for i := range infos {
+		if infos[i].Listed && infos[i].Records > 0 {
+			infos[i].GarbageRatio = 1 - float64(liveRecords[i])/float64(infos[i].Records)
+		}
+	}
+	return infos, nil
+}
+
+// ScanSegment calls fn for every record of the segment file at path in file
+// order. A record that fails its checksum is passed with Err set and the scan
+// goes on after it. A record that does not fit into the rest of the file ends
+// the scan, it is reported with Err set and a Size covering the rest of the
+// file.
+func ScanSegment(path string, fn func(Record) error, opts ...Option) error {
+	o := inspectOptions(opts)
+	_, err := scanSegment(path, &o, func(r Record, _ []byte) error {
+		return fn(r)
+	})
+	return err
+}
+
+// scanSegment works like ScanSegment also passing the raw bytes of every
+// record. It returns the segment with its header fields set and outOffset set
+// to the size of the file.
+func scanSegment(path string, o *options, fn func(r Record, raw []byte) error) (*Segment, error) {
+	s := &Segment{filePath: path}
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	if o.keys != nil {
+		if err := o.unlock(s); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if _, err := f.Seek(s.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	in := bufio.NewReaderSize(f, bufSize)
+	for s.outOffset < size {
+		r, raw, err := scanRecord(in, size-s.outOffset, s.checksum, s.sealer)
+		if err != nil {
+			return nil, err
+		}
+		r.Offset = s.outOffset
+		if err := fn(r, raw); err != nil {
+			return nil, err
+		}
+		s.outOffset += r.Size
+	}
+	return s, nil
+}
+
+// scanRecord reads the next record of at most remaining bytes decrypting it
+// with sl unless it is nil. Invalid records are returned with Err set, the
+// error is reserved for failed reads.
+func scanRecord(in *bufio.Reader, remaining int64, c Checksum, sl *sealer) (Record, []byte, error) {
+	header, _ := in.Peek(headerSize)
+	if len(header) < headerSize || recordSize(header, c) > remaining {
+		raw := make([]byte, remaining)
+		if _, err := io.ReadFull(in, raw); err != nil {
+			return Record{}, nil, err
+		}
+		return Record{Size: remaining, Err: errRecordTooLong}, raw, nil
+	}
+
+	size := recordSize(header, c)
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(in, raw); err != nil {
+		return Record{}, nil, err
+	}
+	var e entry
+	e.Decode(raw)
+	r := Record{
+		Size:       size,
+		Kind:       RecordKind(e.kind),
+		Type:       e.valueType,
+		Compressed: recordFlags(raw)&flagCompressed != 0,
+		Encrypted:  e.sealed != "",
+		Seq:        e.seq,
+		ExpiresAt:  e.expiresAt,
+	}
+	switch {
+	case !bytes.Equal(c.sum(raw[:size-int64(c.size())]), e.sum):
+		r.Err = errBadChecksum
+	case e.sealed != "" && sl == nil:
+		// Without the key the record can only be checked by its checksum.
+	default:
+		if r.Err = e.open(sl); r.Err == nil {
+			r.Err = e.unpack()
+		}
+	}
+	r.Key = e.key
+	r.Value = []byte(e.value)
+	return r, raw, nil
+}
+
+// RepairReport describes what RepairSegment did. Record counts do not include
+// batch headers.
+type RepairReport struct {
+	Kept        int
+	Quarantined int
+	// QuarantinePath is the file that received the removed bytes, empty if
+	// nothing was removed.
+	QuarantinePath   string
+	QuarantinedBytes int64
+}
+
+// RepairSegment rewrites the segment file at path keeping only the records
+// that pass their checksum. Corrupted records, whole batches containing one
+// and a torn tail are appended to a file in the quarantine subdirectory of the
+// data directory. Kept records are copied as they are and the hint of the
+// segment is removed, so the next Open scans it. A segment without corrupted
+// records is left untouched.
+func RepairSegment(path string, opts ...Option) (RepairReport, error) {
+	var report RepairReport
+	o := inspectOptions(opts)
+
+	var (
+		kept, quarantined []byte
+		group             []byte
+		groupLeft         int
+		groupRecords      int
+		groupBroken       bool
+	)
+	finishGroup := func() {
+		if groupBroken {
+			quarantined = append(quarantined, group...)
+			report.Quarantined += groupRecords
+		} else {
+			kept = append(kept, group...)
+			report.Kept += groupRecords
+		}
+		group, groupRecords, groupBroken = nil, 0, false
+	}
+
+	s, err := scanSegment(path, &o, func(r Record, raw []byte) error {
+		if group != nil {
+			group = append(group, raw...)
+			groupRecords++
+			groupBroken = groupBroken || r.Err != nil || r.Kind == RecordBatch
+			if groupLeft--; groupLeft == 0 {
+				finishGroup()
+			}
+			return nil
+		}
+		switch {
+		case r.Err != nil:
+			quarantined = append(quarantined, raw...)
+			report.Quarantined++
+		case r.Kind == RecordBatch && r.BatchSize() > 0:
+			group = append([]byte(nil), raw...)
+			groupLeft = r.BatchSize()
+		default:
+			kept = append(kept, raw...)
+			if r.Kind != RecordBatch {
+				report.Kept++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if group != nil {
+		// The file ended in the middle of a batch.
+		groupBroken = true
+		finishGroup()
+	}
+	if len(quarantined) == 0 {
+		return report, nil
+	}
+
+	header := make([]byte, s.start)
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil {
+		return report, err
+	}
+
+	dir := filepath.Dir(path)
+	report.QuarantinePath = filepath.Join(dir, quarantineDir, filepath.Base(path))
+	report.QuarantinedBytes = int64(len(quarantined))
+	if err := appendQuarantine(report.QuarantinePath, quarantined, o.fileMode); err != nil {
+		return report, err
+	}
+	if err := writeFileAtomically(path, append(header, kept...), o.fileMode); err != nil {
+		return report, err
+	}
+	if err := os.Remove(hintPath(path)); err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	if err := os.Remove(bloomPath(path)); err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	if err := os.Remove(indexPath(path)); err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	return report, syncDir(dir)
+}
+
+// inspectOptions applies opts to the default options without validating
+// them, as only some of them matter to inspection.
+func inspectOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func appendQuarantine(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 120, WithCompactionThreshold(100), WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key1", "value3")
+	db.Delete("key2")
+	b := new(Batch)
+	b.Put("key3", "value4")
+	b.Put("key4", "value5")
+	db.Write(b)
+	db.Put("key5", "value6")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(i int) string {
+		return filepath.Join(dir, outFileName+string(rune('0'+i)))
+	}
+
+	t.Run("list segments", func(t *testing.T) {
+		segments, err := ListSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 4 || !segments[3].Active || segments[2].Active {
+			t.Fatalf("Unexpected segments %+v", segments)
+		}
+		if s := segments[0]; s.Records != 3 || s.Keys != 2 || s.Size != 116 || s.Checksum != ChecksumCRC32C {
+			t.Errorf("Unexpected segment %+v", s)
+		}
+		for i, want := range []float64{2.0 / 3, 1, 0, 0} {
+			if got := segments[i].GarbageRatio; math.Abs(got-want) > 1e-9 {
+				t.Errorf("Expected garbage ratio %g of segment %d, got %g", want, i, got)
+			}
+		}
+	})
+
+	t.Run("scan segment", func(t *testing.T) {
+		var records []Record
+		err := ScanSegment(segment(2), func(r Record) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 || records[0].Kind != RecordBatch || records[0].BatchSize() != 2 {
+			t.Fatalf("Unexpected records %+v", records)
+		}
+		if r := records[2]; r.Offset != 66 || r.Key != "key4" || string(r.Value) != "value5" || r.Seq != 7 {
+			t.Errorf("Unexpected record %+v", r)
+		}
+	})
+
+	// Corrupt the last value byte of key2 and of key4, which is part of the
+	// batch.
+	for _, c := range []struct {
+		segment int
+		offset  int64
+	}{{0, 75}, {2, 97}} {
+		f, err := os.OpenFile(segment(c.segment), os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{'X'}, c.offset)
+		f.Close()
+	}
+
+	t.Run("corruption is found", func(t *testing.T) {
+		segments, err := ListSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []int{1, 0, 1, 0} {
+			if segments[i].Corrupted != want {
+				t.Errorf("Expected %d corrupted records in segment %d, got %+v", want, i, segments[i])
+			}
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		report, err := RepairSegment(segment(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		quarantine := filepath.Join(dir, quarantineDir, outFileName+"0")
+		if report.Kept != 2 || report.Quarantined != 1 || report.QuarantinedBytes != 36 || report.QuarantinePath != quarantine {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if info, err := os.Stat(quarantine); err != nil || info.Size() != 36 {
+			t.Errorf("Expected 36 quarantined bytes, got %v (%v)", info, err)
+		}
+		if _, err := os.Stat(hintPath(segment(0))); !os.IsNotExist(err) {
+			t.Errorf("Expected the hint to be removed, got %v", err)
+		}
+
+		report, err = RepairSegment(segment(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Kept != 0 || report.Quarantined != 2 || report.QuarantinedBytes != 94 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+
+		report, err = RepairSegment(segment(3))
+		if err != nil || report.Quarantined != 0 || report.QuarantinePath != "" {
+			t.Errorf("Expected an intact segment to be left alone, got %+v (%v)", report, err)
+		}
+	})
+
+	t.Run("repaired directory opens", func(t *testing.T) {
+		db, err := NewDb(dir, 120, WithCompactionThreshold(100), WithCompactionInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, want := range map[string]string{"key1": "value3", "key5": "value6"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", want, value, err)
+			}
+		}
+		for _, key := range []string{"key2", "key3", "key4"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The manifest lists the file names of live segments, oldest first, one per
+// line. Segment files that are not listed are leftovers of an interrupted
+// compaction or rollover and are removed on startup.
+//
+// A line "seq N" records the last sequence number issued when the manifest
+// was written, so that numbers of records dropped by compaction are never
+// reused.
+const (
+	manifestFileName = "MANIFEST"
+	tmpSuffix        = ".tmp"
+	manifestSeq      = "seq "
+)
+
+type manifest struct {
+	paths []string
+	seq   uint64
+}
+
+// writeManifest atomically replaces the manifest with the given segment list.
+// It must be called with db.mu held so that manifest updates are ordered.
+func (db *Db) writeManifest(segments []*Segment) error {
+	var buf bytes.Buffer
+	for _, s := range segments {
+		buf.WriteString(filepath.Base(s.filePath))
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&buf, "%s%d\n", manifestSeq, db.seq.Load())
+	return writeFileAtomically(filepath.Join(db.dir, manifestFileName), buf.Bytes(), db.opts.fileMode)
+}
+
+// readManifest returns the manifest of dir with paths of the listed segments.
+// The error satisfies os.IsNotExist if there is no manifest.
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return m, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		if seq := strings.TrimPrefix(name, manifestSeq); seq != name {
+			if m.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+				return m, fmt.Errorf("bad sequence number in manifest: %w", err)
+			}
+			continue
+		}
+		if name != filepath.Base(name) {
+			return m, fmt.Errorf("bad segment name %q in manifest", name)
+		}
+		m.paths = append(m.paths, filepath.Join(dir, name))
+	}
+	return m, scanner.Err()
+}
+
+// writeFileAtomically writes data to a temporary file, flushes it and renames
+// it over path so that readers see either the old or the new content.
+func writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+	tmpPath := path + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes directory entries so that created, renamed and removed files
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
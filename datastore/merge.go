@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// MergeOperator combines the current value of a key with an operand and
+// returns the value to store. Values are string, int64 or []byte; found is
+// false when the key does not exist and current is nil.
+type MergeOperator func(current interface{}, found bool, operand interface{}) (interface{}, error)
+
+var (
+	// MergeAppend appends a string operand to a string value.
+	MergeAppend MergeOperator = mergeAppend
+	// MergeAdd adds an int64 operand to an int64 value.
+	MergeAdd MergeOperator = mergeAdd
+	// MergeMax keeps the greater of the value and the operand.
+	MergeMax MergeOperator = mergeMax
+	// MergeMin keeps the lesser of the value and the operand.
+	MergeMin MergeOperator = mergeMin
+)
+
+type mergeRequest struct {
+	operand interface{}
+	op      MergeOperator
+	result  interface{}
+}
+
+// Merge atomically replaces the value of the key with the result of op
+// applied to the stored value and the operand, and returns the new value.
+// A key that expires keeps its expiry time. Merges are executed by the same
+// goroutine that appends records, so concurrent merges of one key never lose
+// updates.
+func (db *Db) Merge(key string, operand interface{}, op MergeOperator) (interface{}, error) {
+	merge := &mergeRequest{
+		operand: operand,
+		op:      op,
+	}
+	err := db.send(EntryWithChan{
+		e:     entry{key: key},
+		merge: merge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merge.result, nil
+}
+
+// Increment atomically adds delta to an int64 value, treating a missing key
+// as zero, and returns the new value. Like Merge, it keeps the expiry time of
+// the key.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	result, err := db.Merge(key, delta, MergeAdd)
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+// resolveMerge turns a merge request into the entry that has to be written.
+// It must only be called from the put goroutine.
+func (db *Db) resolveMerge(op *EntryWithChan) error {
+	key := op.e.key
+	var current interface{}
+	found := true
+	e, err := db.getEntry(key)
+	if err == ErrNotFound {
+		found = false
+	} else if err != nil {
+		return err
+	} else if current, err = e.typedValue(); err != nil {
+		return err
+	}
+
+	result, err := op.merge.op(current, found, op.merge.operand)
+	var mismatch *TypeMismatchError
+	if errors.As(err, &mismatch) {
+		mismatch.Key = key
+	}
+	if err != nil {
+		return err
+	}
+
+	switch v := result.(type) {
+	case string:
+		op.e = entry{key: key, value: v, valueType: TypeString}
+	case int64:
+		op.e = entry{key: key, value: encodeInt64(v), valueType: TypeInt64}
+	case []byte:
+		op.e = entry{key: key, value: string(v), valueType: TypeBytes}
+	default:
+		return fmt.Errorf("unsupported merge result type %T", result)
+	}
+	op.e.expiresAt = e.expiresAt
+	op.merge.result = result
+	return nil
+}
+
+func (e *entry) typedValue() (interface{}, error) {
+	switch e.valueType {
+	case TypeString:
+		return e.value, nil
+	case TypeInt64:
+		return decodeInt64(e.value)
+	case TypeBytes:
+		return []byte(e.value), nil
+	default:
+		return nil, fmt.Errorf("unknown value type %s", e.valueType)
+	}
+}
+
+func valueTypeOf(v interface{}) (ValueType, error) {
+	switch v.(type) {
+	case string:
+		return TypeString, nil
+	case int64:
+		return TypeInt64, nil
+	case []byte:
+		return TypeBytes, nil
+	default:
+		return 0, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// checkTypes makes sure current, when present, has the same type as operand.
+func checkTypes(current interface{}, found bool, operand interface{}) (ValueType, error) {
+	t, err := valueTypeOf(operand)
+	if err != nil || !found {
+		return t, err
+	}
+	actual, err := valueTypeOf(current)
+	if err != nil {
+		return t, err
+	}
+	if actual != t {
+		return t, &TypeMismatchError{Expected: t, Actual: actual}
+	}
+	return t, nil
+}
+
+func mergeAppend(current interface{}, found bool, operand interface{}) (interface{}, error) {
+	t, err := checkTypes(current, found, operand)
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeString {
+		return nil, &TypeMismatchError{Expected: TypeString, Actual: t}
+	}
+	if !found {
+		return operand, nil
+	}
+	return current.(string) + operand.(string), nil
+}
+
+func mergeAdd(current interface{}, found bool, operand interface{}) (interface{}, error) {
+	t, err := checkTypes(current, found, operand)
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeInt64 {
+		return nil, &TypeMismatchError{Expected: TypeInt64, Actual: t}
+	}
+	if !found {
+		return operand, nil
+	}
+	return current.(int64) + operand.(int64), nil
+}
+
+func mergeMax(current interface{}, found bool, operand interface{}) (interface{}, error) {
+	return mergeCompare(current, found, operand, 1)
+}
+
+func mergeMin(current interface{}, found bool, operand interface{}) (interface{}, error) {
+	return mergeCompare(current, found, operand, -1)
+}
+
+// mergeCompare keeps the operand when it compares to the current value with
+// the given sign. Strings and byte slices are compared lexicographically.
+func mergeCompare(current interface{}, found bool, operand interface{}, sign int) (interface{}, error) {
+	t, err := checkTypes(current, found, operand)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return operand, nil
+	}
+
+	var cmp int
+	switch t {
+	case TypeString:
+		a, b := operand.(string), current.(string)
+		if a > b {
+			cmp = 1
+		} else if a < b {
+			cmp = -1
+		}
+	case TypeInt64:
+		a, b := operand.(int64), current.(int64)
+		if a > b {
+			cmp = 1
+		} else if a < b {
+			cmp = -1
+		}
+	case TypeBytes:
+		cmp = bytes.Compare(operand.([]byte), current.([]byte))
+	}
+	if cmp == sign {
+		return operand, nil
+	}
+	return current, nil
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDb_Increment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := db.Increment("counter", 1); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.GetInt64("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 200 {
+			t.Errorf("Bad value returned expected 200, got %d", value)
+		}
+	})
+
+	t.Run("increment of a string", func(t *testing.T) {
+		db.Put("name", "value")
+		var mismatch *TypeMismatchError
+		if _, err := db.Increment("name", 1); !errors.As(err, &mismatch) || mismatch.Key != "name" {
+			t.Errorf("Expected type mismatch error, got %v", err)
+		}
+	})
+}
+
+func TestDb_Merge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	steps := []struct {
+		key      string
+		operand  interface{}
+		op       MergeOperator
+		expected interface{}
+	}{
+		{"str", "a", MergeAppend, "a"},
+		{"str", "b", MergeAppend, "ab"},
+		{"str", "aa", MergeMax, "ab"},
+		{"str", "aa", MergeMin, "aa"},
+		{"num", int64(5), MergeMax, int64(5)},
+		{"num", int64(3), MergeMax, int64(5)},
+		{"num", int64(3), MergeMin, int64(3)},
+		{"num", int64(4), MergeAdd, int64(7)},
+	}
+	for _, step := range steps {
+		result, err := db.Merge(step.key, step.operand, step.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != step.expected {
+			t.Errorf("Bad merge result expected %v, got %v", step.expected, result)
+		}
+	}
+
+	if value, err := db.Get("str"); err != nil || value != "aa" {
+		t.Errorf("Bad value returned expected aa, got %s (%v)", value, err)
+	}
+	if _, err := db.Merge("num", "x", MergeAppend); err == nil {
+		t.Error("Expected an error appending to int64")
+	}
+}
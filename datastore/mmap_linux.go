@@ -0,0 +1,23 @@
+package datastore
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the current contents of f into memory read-only. An empty
+// file is not mapped.
+func mmapFile(f *os.File) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
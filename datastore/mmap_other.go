@@ -0,0 +1,15 @@
+//go:build !linux
+
+package datastore
+
+import "os"
+
+// mmapFile does not map anything on platforms other than Linux, so all reads
+// go through the file.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
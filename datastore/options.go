@@ -0,0 +1,296 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	defaultSegmentSize            = 10 * 1024 * 1024
+	defaultCompactionThreshold    = 3
+	defaultFileMode               = os.FileMode(0o644)
+	defaultCompactionInterval     = time.Minute
+	defaultGarbageRatio           = 0.5
+	defaultExpirySweepInterval    = time.Minute
+	defaultBloomFalsePositiveRate = 0.01
+)
+
+var (
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+// Option configures a Db created by Open.
+type Option func(*options)
+
+type options struct {
+	segmentSize            int64
+	compactionThreshold    int
+	compactionInterval     time.Duration
+	garbageRatio           float64
+	expirySweepInterval    time.Duration
+	checksum               Checksum
+	fileMode               os.FileMode
+	syncMode               SyncMode
+	maxKeySize             int
+	maxValueSize           int
+	codec                  Codec
+	compressThreshold      int
+	keys                   KeyProvider
+	mmap                   bool
+	bloomFalsePositiveRate float64
+	indexBlockSize         int
+	logger                 *log.Logger
+	recoveryHandler        func(RecoveryReport)
+}
+
+func defaultOptions() options {
+	return options{
+		segmentSize:            defaultSegmentSize,
+		compactionThreshold:    defaultCompactionThreshold,
+		compactionInterval:     defaultCompactionInterval,
+		garbageRatio:           defaultGarbageRatio,
+		expirySweepInterval:    defaultExpirySweepInterval,
+		checksum:               ChecksumCRC32C,
+		fileMode:               defaultFileMode,
+		syncMode:               SyncNone,
+		bloomFalsePositiveRate: defaultBloomFalsePositiveRate,
+		logger:                 log.New(io.Discard, "", 0),
+	}
+}
+
+func (o *options) validate() error {
+	if o.segmentSize <= 0 {
+		return fmt.Errorf("segment size must be positive, got %d", o.segmentSize)
+	}
+	if o.compactionThreshold < 2 {
+		return fmt.Errorf("compaction threshold must be at least 2 segments, got %d", o.compactionThreshold)
+	}
+	if o.compactionInterval < 0 {
+		return fmt.Errorf("compaction interval must not be negative, got %s", o.compactionInterval)
+	}
+	if o.expirySweepInterval < 0 {
+		return fmt.Errorf("expiry sweep interval must not be negative, got %s", o.expirySweepInterval)
+	}
+	if o.garbageRatio <= 0 || o.garbageRatio > 1 {
+		return fmt.Errorf("garbage ratio must be in (0, 1], got %g", o.garbageRatio)
+	}
+	if !o.checksum.valid() {
+		return fmt.Errorf("unknown checksum algorithm %s", o.checksum)
+	}
+	if o.fileMode&0o600 != 0o600 {
+		return fmt.Errorf("file mode %o must allow the owner to read and write", o.fileMode)
+	}
+	if o.syncMode.kind == syncInterval && o.syncMode.interval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %s", o.syncMode.interval)
+	}
+	if o.maxKeySize < 0 || o.maxValueSize < 0 {
+		return fmt.Errorf("max key and value sizes must not be negative, got %d and %d", o.maxKeySize, o.maxValueSize)
+	}
+	if o.maxKeySize > 0 && o.maxValueSize > 0 {
+		largest := int64(o.maxKeySize+o.maxValueSize) + headerSize + seqSize + int64(o.checksum.size())
+		if o.keys != nil {
+			largest += sealOverhead
+		}
+		if largest > o.segmentSize {
+			return fmt.Errorf("a record with max key size %d and max value size %d needs %d bytes and does not fit into a %d byte segment",
+				o.maxKeySize, o.maxValueSize, largest, o.segmentSize)
+		}
+	}
+	if o.codec != nil {
+		if o.compressThreshold <= 0 {
+			return fmt.Errorf("compression threshold must be positive, got %d", o.compressThreshold)
+		}
+		if _, err := lookupCodec(o.codec.ID()); err != nil {
+			return fmt.Errorf("codec %d is not registered", o.codec.ID())
+		}
+	}
+	if _, err := o.currentSealer(); err != nil {
+		return err
+	}
+	if o.bloomFalsePositiveRate < 0 || o.bloomFalsePositiveRate >= 1 {
+		return fmt.Errorf("bloom filter false positive rate must be in [0, 1), got %g", o.bloomFalsePositiveRate)
+	}
+	if o.indexBlockSize < 0 {
+		return fmt.Errorf("index block size must not be negative, got %d", o.indexBlockSize)
+	}
+	if o.logger == nil {
+		return errors.New("logger must not be nil")
+	}
+	return nil
+}
+
+// checkSize returns an error if the entry exceeds the configured limits.
+func (o *options) checkSize(e *entry) error {
+	if o.maxKeySize > 0 && len(e.key) > o.maxKeySize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrKeyTooLarge, len(e.key), o.maxKeySize)
+	}
+	if o.maxValueSize > 0 && len(e.value) > o.maxValueSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrValueTooLarge, len(e.value), o.maxValueSize)
+	}
+	return nil
+}
+
+// compress stores the value of a value record compressed when compression is
+// enabled, the value is at least the threshold long and compressing makes it
+// smaller.
+func (o *options) compress(e *entry) error {
+	if o.codec == nil || e.kind != kindValue || e.stored != "" || len(e.value) < o.compressThreshold {
+		return nil
+	}
+	stored, ok, err := compress(o.codec, e.value)
+	if ok {
+		e.stored = stored
+	}
+	return err
+}
+
+// WithSegmentSize sets the size after which a new segment file is started.
+func WithSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.segmentSize = size
+	}
+}
+
+// WithCompactionThreshold sets the number of segments that triggers merging
+// of all sealed segments. The default is 3.
+func WithCompactionThreshold(segments int) Option {
+	return func(o *options) {
+		o.compactionThreshold = segments
+	}
+}
+
+// WithCompactionInterval sets how often the garbage ratio of sealed segments
+// is checked to decide whether to compact them. Zero disables scheduled
+// compaction. The default is one minute.
+func WithCompactionInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.compactionInterval = interval
+	}
+}
+
+// WithGarbageRatio sets the share of shadowed records in sealed segments above
+// which scheduled compaction runs. The default is 0.5.
+func WithGarbageRatio(ratio float64) Option {
+	return func(o *options) {
+		o.garbageRatio = ratio
+	}
+}
+
+// WithExpirySweepInterval sets how often expired keys are deleted in
+// background. Zero disables the sweeper, expired keys are then only hidden
+// from reads and dropped by compaction. The default is one minute.
+func WithExpirySweepInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.expirySweepInterval = interval
+	}
+}
+
+// WithChecksum sets the algorithm protecting records of new segments. The
+// default is ChecksumCRC32C. Existing segments keep their algorithm.
+func WithChecksum(c Checksum) Option {
+	return func(o *options) {
+		o.checksum = c
+	}
+}
+
+// WithFileMode sets permissions of newly created segment files.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode
+	}
+}
+
+// WithMaxKeySize limits the length of keys accepted by writes. Zero means no
+// limit.
+func WithMaxKeySize(size int) Option {
+	return func(o *options) {
+		o.maxKeySize = size
+	}
+}
+
+// WithMaxValueSize limits the length of values accepted by writes. Zero means
+// no limit.
+func WithMaxValueSize(size int) Option {
+	return func(o *options) {
+		o.maxValueSize = size
+	}
+}
+
+// WithCompression compresses values of at least threshold bytes with the
+// codec, which must be registered. Values are stored as is by default. Records
+// already written stay readable whatever the option, compaction compresses
+// the ones that qualify.
+func WithCompression(codec Codec, threshold int) Option {
+	return func(o *options) {
+		o.codec = codec
+		o.compressThreshold = threshold
+	}
+}
+
+// WithEncryption encrypts keys and values of new segments with AES-GCM under
+// the current key of keys. Segments are not encrypted by default. Encrypted
+// segments can only be opened with a provider that has their key, plain ones
+// are encrypted once compaction rewrites them.
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithMmap makes segments map their files into memory for reads instead of
+// reading them with system calls. It only has an effect on Linux and is off by
+// default.
+func WithMmap(enabled bool) Option {
+	return func(o *options) {
+		o.mmap = enabled
+	}
+}
+
+// WithBloomFilter sets the false positive rate of the Bloom filters that let
+// lookups skip sealed segments without the key. The default is 0.01, zero
+// disables the filters.
+func WithBloomFilter(falsePositiveRate float64) Option {
+	return func(o *options) {
+		o.bloomFalsePositiveRate = falsePositiveRate
+	}
+}
+
+// WithDiskIndex moves the indexes of sealed segments to index files stored
+// next to them, split into blocks of about blockSize bytes, so that only the
+// first key of every block is kept in memory. Lookups in sealed segments then
+// read a block from disk. The active segment always keeps its index in memory.
+// The default is zero, which keeps all indexes in memory.
+func WithDiskIndex(blockSize int) Option {
+	return func(o *options) {
+		o.indexBlockSize = blockSize
+	}
+}
+
+// WithLogger sets the logger used to report background failures and recovery
+// results. Nothing is logged by default.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRecoveryHandler registers a callback that receives the RecoveryReport
+// once Open has loaded the existing segments.
+func WithRecoveryHandler(handler func(RecoveryReport)) Option {
+	return func(o *options) {
+		o.recoveryHandler = handler
+	}
+}
+
+// WithSyncMode sets when written records are flushed to disk. The default is
+// SyncNone.
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *options) {
+		o.syncMode = mode
+	}
+}
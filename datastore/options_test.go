@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen_Validation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := map[string][]Option{
+		"zero segment size":       {WithSegmentSize(0)},
+		"compaction threshold":    {WithCompactionThreshold(1)},
+		"read only file mode":     {WithFileMode(0o444)},
+		"zero sync interval":      {WithSyncMode(SyncInterval(0))},
+		"negative max key size":   {WithMaxKeySize(-1)},
+		"record above segment":    {WithSegmentSize(100), WithMaxKeySize(50), WithMaxValueSize(50)},
+		"nil logger":              {WithLogger(nil)},
+		"negative interval":       {WithCompactionInterval(-time.Second)},
+		"garbage ratio above 1":   {WithGarbageRatio(1.5)},
+		"negative sweep interval": {WithExpirySweepInterval(-time.Second)},
+		"unknown checksum":        {WithChecksum(Checksum(9))},
+		"zero compression size":   {WithCompression(FlateCodec, 0)},
+		"unregistered codec":      {WithCompression(gzipCodec{id: 250}, 100)},
+		"bloom rate of 1":         {WithBloomFilter(1)},
+		"negative index block":    {WithDiskIndex(-1)},
+	}
+	for name, opts := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if db, err := Open(dir, opts...); err == nil {
+				db.Close()
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestOpen_Options(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithFileMode(0o600), WithMaxKeySize(4), WithMaxValueSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("file mode", func(t *testing.T) {
+		info, err := os.Stat(filepath.Join(dir, outFileName+"0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("Expected file mode 600, got %o", info.Mode().Perm())
+		}
+	})
+
+	t.Run("size limits", func(t *testing.T) {
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Errorf("Cannot put key1: %s", err)
+		}
+		if err := db.Put("key10", "value"); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if err := db.Put("key2", "long value"); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+	})
+}
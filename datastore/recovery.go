@@ -0,0 +1,353 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RecoveryReport describes what NewDb found while loading the data directory.
+type RecoveryReport struct {
+	Segments int
+	Records  int
+	// DiscardedBytes is the size of the torn tail cut off the active segment.
+	DiscardedBytes int64
+	// TruncatedSegment is the path of the active segment when it was truncated.
+	TruncatedSegment string
+	// RemovedFiles lists leftovers of interrupted compactions that were not
+	// recorded in the manifest and got deleted.
+	RemovedFiles []string
+	// HintedSegments is the number of sealed segments whose index was loaded
+	// from a hint file instead of scanning the segment.
+	HintedSegments int
+	// RebuiltBloomFilters is the number of sealed segments whose Bloom filter
+	// was missing or invalid and was built from the index.
+	RebuiltBloomFilters int
+	// IndexedSegments is the number of sealed segments whose on-disk index was
+	// opened from its file, without loading their keys into memory.
+	IndexedSegments int
+}
+
+// CorruptionError is returned by NewDb when a sealed segment contains a record
+// that cannot be read or fails its checksum. Such segments are never truncated
+// automatically as they may hold data that is still referenced.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("segment %s is corrupted at offset %d: %s", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// recover loads the segments listed in the manifest of db.dir, rebuilds their
+// indexes and reopens the newest one for appending. Directories written before
+// manifests were introduced are loaded in the numeric order of segment files.
+// An empty directory gets a fresh segment.
+func (db *Db) recover() (RecoveryReport, error) {
+	var report RecoveryReport
+	paths, indexes, err := findSegmentFiles(db.dir)
+	if err != nil {
+		return report, err
+	}
+	if len(indexes) > 0 {
+		db.lastSegmentIndex = indexes[len(indexes)-1] + 1
+	}
+
+	m, err := readManifest(db.dir)
+	hasManifest := err == nil
+	live := m.paths
+	if os.IsNotExist(err) {
+		live = paths
+	} else if err != nil {
+		return report, err
+	}
+	db.seq.Store(m.seq)
+	if m.seq < unversioned {
+		db.seq.Store(unversioned)
+	}
+	removed, err := removeLeftovers(db.dir, live)
+	if err != nil {
+		return report, err
+	}
+	report.RemovedFiles = removed
+
+	if len(live) == 0 {
+		return report, db.createSegment()
+	}
+	segments := make([]*Segment, 0, len(live))
+	for i, path := range live {
+		s, err := db.loadSegment(path, i == len(live)-1, &report)
+		if err != nil {
+			return report, err
+		}
+		segments = append(segments, s)
+	}
+	db.setSegments(segments)
+	report.Segments = len(segments)
+	if !hasManifest {
+		if err := db.writeManifest(segments); err != nil {
+			return report, err
+		}
+	}
+
+	last := db.getLastSegment()
+	f, err := os.OpenFile(last.filePath, os.O_APPEND|os.O_RDWR, db.opts.fileMode)
+	if err != nil {
+		return report, err
+	}
+	db.out = f
+	db.outPath = last.filePath
+	db.outOffset = last.outOffset
+	return report, nil
+}
+
+// loadSegment rebuilds the index of a segment. Sealed segments are loaded from
+// their hint files when possible, otherwise they are scanned and a hint is
+// written for the next startup. With WithDiskIndex sealed segments open their
+// index files instead, and a missing or invalid index file is rebuilt from the
+// hint or the records. Only expiry times of the active segment are kept in
+// memory, sealed segments remember their earliest one.
+func (db *Db) loadSegment(path string, active bool, report *RecoveryReport) (*Segment, error) {
+	s := &Segment{
+		filePath: path,
+		index:    make(hashIndex),
+		mmap:     db.opts.mmap,
+	}
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	if err := db.opts.unlock(s); err != nil {
+		return nil, err
+	}
+	if !active && db.opts.indexBlockSize > 0 {
+		expiries, err := s.loadDiskIndex()
+		if err == nil {
+			report.IndexedSegments++
+			report.Records += s.records
+			s.nextExpiry = earliestExpiry(expiries)
+			db.loadBloom(s, report)
+			return s, nil
+		}
+		if !os.IsNotExist(err) {
+			db.opts.logger.Printf("datastore: ignoring index of %s: %s", path, err)
+		}
+	}
+	if !active {
+		expiries, err := s.loadHint()
+		if err == nil {
+			report.HintedSegments++
+			report.Records += s.records
+			s.nextExpiry = earliestExpiry(expiries)
+			db.loadBloom(s, report)
+			if db.opts.indexBlockSize > 0 {
+				db.sealIndex(s, expiries)
+			}
+			return s, nil
+		}
+		if !os.IsNotExist(err) {
+			db.opts.logger.Printf("datastore: ignoring hint of %s: %s", path, err)
+		}
+	}
+
+	var seq uint64
+	if err := s.recover(report, active, &seq); err != nil {
+		return nil, err
+	}
+	if seq > db.seq.Load() {
+		db.seq.Store(seq)
+	}
+	expiries := s.hintExpiries()
+	if active {
+		db.expiries = expiries
+	} else {
+		s.nextExpiry = earliestExpiry(expiries)
+		db.loadBloom(s, report)
+		db.sealIndex(s, expiries)
+		s.hints = nil
+	}
+	return s, nil
+}
+
+// loadBloom loads the Bloom filter of a sealed segment, rebuilding it when its
+// file is missing or invalid.
+func (db *Db) loadBloom(s *Segment, report *RecoveryReport) {
+	if db.opts.bloomFalsePositiveRate == 0 {
+		return
+	}
+	err := s.loadBloom()
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		db.opts.logger.Printf("datastore: ignoring bloom filter of %s: %s", s.filePath, err)
+	}
+	report.RebuiltBloomFilters++
+	db.sealBloom(s)
+}
+
+// removeLeftovers deletes segment and temporary files in dir that are not
+// among the live segments: results of compactions or rollovers interrupted
+// before they were recorded in the manifest.
+func removeLeftovers(dir string, live []string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	isLive := make(map[string]bool, len(live))
+	for _, path := range live {
+		isLive[filepath.Base(path)] = true
+	}
+
+	var removed []string
+	for _, f := range files {
+		name := f.Name()
+		base := name
+		for _, suffix := range []string{hintSuffix, bloomSuffix, indexSuffix} {
+			base = strings.TrimSuffix(base, suffix)
+		}
+		if f.IsDir() || isLive[base] {
+			continue
+		}
+		if !strings.HasPrefix(name, outFileName) && name != manifestFileName+tmpSuffix {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+
+	for name := range isLive {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return removed, fmt.Errorf("segment listed in the manifest is missing: %w", err)
+		}
+	}
+	return removed, nil
+}
+
+// findSegmentFiles returns paths of the segment files in dir sorted by their
+// sequence number together with those numbers.
+func findSegmentFiles(dir string) ([]string, []int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var indexes []int
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	paths := make([]string, len(indexes))
+	for i, index := range indexes {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%s%d", outFileName, index))
+	}
+	return paths, indexes, nil
+}
+
+// recover rebuilds the segment index by reading and verifying all records of
+// its file that follow the header read by readHeader. Batches are indexed only
+// when all their records are intact. A short or invalid record in the active
+// segment is treated as a torn write: the file is truncated back to the last
+// valid record. The same problem in a sealed segment is reported as a
+// CorruptionError. Records of an encrypted segment are decrypted with its
+// sealer. The greatest sequence number found is stored in maxSeq.
+func (s *Segment) recover(report *RecoveryReport, active bool, maxSeq *uint64) error {
+	f, err := os.Open(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+	if _, err := f.Seek(s.outOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(f, bufSize)
+	for s.outOffset < fileSize {
+		entries, offsets, size, err := readRecoveredGroup(in, fileSize-s.outOffset, s.checksum)
+		if err != nil {
+			if !isInvalidRecord(err) {
+				return err
+			}
+			if !active {
+				return &CorruptionError{Path: s.filePath, Offset: s.outOffset, Err: err}
+			}
+			if err := os.Truncate(s.filePath, s.outOffset); err != nil {
+				return err
+			}
+			report.DiscardedBytes += fileSize - s.outOffset
+			report.TruncatedSegment = s.filePath
+			return nil
+		}
+
+		for i, e := range entries {
+			// A record that passed its checksum but cannot be decrypted was
+			// not torn, so it is never truncated.
+			if err := e.open(s.sealer); err != nil {
+				return fmt.Errorf("%s at offset %d: %w", s.filePath, s.outOffset+offsets[i], err)
+			}
+			if e.seq > *maxSeq {
+				*maxSeq = e.seq
+			}
+			end := size
+			if i+1 < len(offsets) {
+				end = offsets[i+1]
+			}
+			s.index.(hashIndex)[e.key] = s.outOffset + offsets[i]
+			s.addHint(e.key, s.outOffset+offsets[i], end-offsets[i], e.expiresAt, e.sum)
+		}
+		s.outOffset += size
+		s.records += len(entries)
+		report.Records += len(entries)
+	}
+	return nil
+}
+
+var errRecordTooLong = errors.New("record is longer than the rest of the file")
+
+// readRecoveredEntry reads the next record making sure it fits into the
+// remaining bytes of the file and returns it with its size in the file.
+// Compressed values are not decompressed.
+func readRecoveredEntry(in *bufio.Reader, remaining int64, c Checksum) (entry, int64, error) {
+	header, err := in.Peek(headerSize)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	size := recordSize(header, c)
+	if size > remaining {
+		return entry{}, 0, errRecordTooLong
+	}
+	e, err := readRecord(in, c)
+	return e, size, err
+}
+
+func isInvalidRecord(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errBadChecksum) || errors.Is(err, errRecordTooLong) || errors.Is(err, errBadBatch)
+}
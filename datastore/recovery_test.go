@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_RecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, outFileName+"0")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := info.Size()
+
+	torn := entry{key: "key3", value: "value3", checksum: ChecksumCRC32C}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := torn.Encode()
+	f.Write(data[:len(data)-5])
+	f.Close()
+
+	var report RecoveryReport
+	db, err = NewDb(dir, 1000, WithRecoveryHandler(func(r RecoveryReport) {
+		report = r
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if report.DiscardedBytes != int64(len(data)-5) {
+		t.Errorf("Expected %d discarded bytes, got %d", len(data)-5, report.DiscardedBytes)
+	}
+	if report.Records != 2 || report.TruncatedSegment != path {
+		t.Errorf("Unexpected recovery report %+v", report)
+	}
+	if info, _ := os.Stat(path); info.Size() != validSize {
+		t.Errorf("Expected file to be truncated to %d, got %d", validSize, info.Size())
+	}
+
+	if _, err := db.Get("key3"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for torn record, got %v", err)
+	}
+	db.Put("key3", "value3")
+	for _, pair := range [][]string{{"key1", "value1"}, {"key2", "value2"}, {"key3", "value3"}} {
+		if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+		}
+	}
+}
+
+func TestDb_RecoverBadChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("active segment is truncated", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"1")
+		f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{'X'}, 20)
+		f.Close()
+
+		var report RecoveryReport
+		db, err := NewDb(dir, 100, WithRecoveryHandler(func(r RecoveryReport) {
+			report = r
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if report.DiscardedBytes != 36 {
+			t.Errorf("Expected 36 discarded bytes, got %d", report.DiscardedBytes)
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("sealed segment is reported", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		// Sealed segments with a hint are not scanned on startup.
+		if err := os.Remove(hintPath(path)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{'X'}, 20)
+		f.Close()
+
+		_, err = NewDb(dir, 100)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) {
+			t.Fatalf("Expected CorruptionError, got %v", err)
+		}
+		if corruption.Path != path || corruption.Offset != segmentHeaderSize {
+			t.Errorf("Unexpected corruption error %v", corruption)
+		}
+	})
+}
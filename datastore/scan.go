@@ -0,0 +1,155 @@
+package datastore
+
+// Iterator walks the keys selected by Db.Scan in lexicographic order.
+//
+//	it := db.Scan("user:", "", 0)
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	get func(key string) (entry, error)
+	// open returns cursors over the selected keys not less than from, oldest
+	// first, and the segments that compaction may remove while they are read.
+	open     func(from string) ([]indexCursor, []*Segment)
+	keys     *mergeCursor
+	segments []*Segment
+	// from is the least key not yet taken from keys.
+	from   string
+	limit  int
+	count  int
+	err    error
+	closed bool
+
+	key       string
+	value     interface{}
+	valueType ValueType
+}
+
+// Scan returns an iterator over live keys starting with prefix that are not
+// less than from, yielding at most limit of them. A zero limit means no limit.
+// Keys are read from the segment indexes in order as the iterator advances and
+// the scan stops once limit live keys were found. Values are read at the same
+// time, so keys deleted in the meantime are skipped.
+func (db *Db) Scan(prefix, from string, limit int) *Iterator {
+	return newIterator(from, limit, db.getEntry, func(from string) ([]indexCursor, []*Segment) {
+		segments := db.getSegments()
+		cursors := make([]indexCursor, len(segments))
+		for i, s := range segments {
+			s.mu.RLock()
+			cursors[i] = newCursor(s.index, prefix, from)
+			s.mu.RUnlock()
+		}
+		return cursors, segments
+	})
+}
+
+func newIterator(from string, limit int, get func(key string) (entry, error), open func(from string) ([]indexCursor, []*Segment)) *Iterator {
+	it := &Iterator{
+		get:   get,
+		open:  open,
+		from:  from,
+		limit: limit,
+	}
+	it.reopen()
+	return it
+}
+
+func (it *Iterator) reopen() {
+	var cursors []indexCursor
+	cursors, it.segments = it.open(it.from)
+	it.keys = newMergeCursor(cursors)
+}
+
+// nextKey returns the next selected key. If reading an on-disk index fails
+// because compaction removed its segment meanwhile, the keys are read again
+// from the current segments starting after the last key taken.
+func (it *Iterator) nextKey() (string, bool, error) {
+	for {
+		key, _, _, ok, err := it.keys.next()
+		if err != nil && it.obsolete() {
+			it.reopen()
+			continue
+		}
+		if ok {
+			// The least string greater than key.
+			it.from = key + "\x00"
+		}
+		return key, ok, err
+	}
+}
+
+func (it *Iterator) obsolete() bool {
+	for _, s := range it.segments {
+		if s.obsolete.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// Next advances the iterator to the next live key. It returns false when the
+// keys are exhausted, the limit is reached or reading a value failed.
+func (it *Iterator) Next() bool {
+	if it.closed || it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+	for {
+		key, ok, err := it.nextKey()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !ok {
+			return false
+		}
+
+		e, err := it.get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err == nil {
+			it.value, err = e.typedValue()
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key = key
+		it.valueType = e.valueType
+		it.count++
+		return true
+	}
+}
+
+// Key returns the key at the current position.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value at the current position: a string, an int64 or a
+// []byte depending on Type.
+func (it *Iterator) Value() interface{} {
+	return it.value
+}
+
+// Type returns the type of the value at the current position.
+func (it *Iterator) Type() ValueType {
+	return it.valueType
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. Next returns false afterwards.
+func (it *Iterator) Close() error {
+	it.keys = nil
+	it.segments = nil
+	it.closed = true
+	return nil
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func scanKeys(t *testing.T, it *Iterator) []string {
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("user:2", "bob")
+	db.Put("user:1", "alice")
+	db.Put("group:1", "admins")
+	db.PutInt64("user:3", 3)
+	db.Put("user:1", "ann")
+	db.Put("user:4", "dan")
+	db.Delete("user:2")
+
+	t.Run("prefix", func(t *testing.T) {
+		expected := []string{"user:1", "user:3", "user:4"}
+		if keys := scanKeys(t, db.Scan("user:", "", 0)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("from and limit", func(t *testing.T) {
+		expected := []string{"user:3"}
+		if keys := scanKeys(t, db.Scan("user:", "user:2", 1)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+		expected = []string{"group:1", "user:1"}
+		if keys := scanKeys(t, db.Scan("", "", 2)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("newest values", func(t *testing.T) {
+		it := db.Scan("user:", "", 2)
+		defer it.Close()
+		expected := []interface{}{"ann", int64(3)}
+		var values []interface{}
+		for it.Next() {
+			values = append(values, it.Value())
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("Expected values %v, got %v", expected, values)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		it := db.Scan("", "", 0)
+		it.Close()
+		if it.Next() {
+			t.Error("Expected closed iterator to be exhausted")
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var errSegmentClosed = errors.New("segment file is closed")
+
+// segmentFile is the read-only handle of a segment file shared by all reads of
+// the segment. It is opened on the first read and closed once the segment is
+// retired and no read uses it any more. With mmap the part of the file that
+// existed when it was opened is mapped into memory, records appended later to
+// the active segment are read from the file. The on-disk index of a segment is
+// read through a handle of its own.
+type segmentFile struct {
+	mu      sync.Mutex
+	file    *os.File
+	data    []byte
+	refs    int
+	retired bool
+	// onClose runs once the retired file is closed.
+	onClose func()
+}
+
+// acquireFile returns the shared handle of the segment file opening it if
+// needed. Every handle returned must be released.
+func (s *Segment) acquireFile() (*segmentFile, error) {
+	return s.file.acquire(s.filePath, s.mmap)
+}
+
+// acquire returns the handle opening the file at path if needed.
+func (f *segmentFile) acquire(path string, mmap bool) (*segmentFile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.retired {
+		return nil, errSegmentClosed
+	}
+	if f.file == nil {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if mmap {
+			if f.data, err = mmapFile(file); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+		f.file = file
+	}
+	f.refs++
+	return f, nil
+}
+
+// release ends a read started by acquireFile.
+func (f *segmentFile) release() {
+	f.mu.Lock()
+	f.refs--
+	closed := f.refs == 0 && f.retired
+	if closed {
+		f.close()
+	}
+	onClose := f.onClose
+	f.mu.Unlock()
+	if closed && onClose != nil {
+		onClose()
+	}
+}
+
+// retireFile closes the segment file and the file of its on-disk index as soon
+// as no read uses them and then runs onClose, if it is not nil. Later reads of
+// the segment fail.
+func (s *Segment) retireFile(onClose func()) {
+	if index, ok := s.getIndex().(*diskIndex); ok {
+		index.file.retire(nil)
+	}
+	s.file.retire(onClose)
+}
+
+// retire closes the file once no read uses it and then runs onClose.
+func (f *segmentFile) retire(onClose func()) {
+	f.mu.Lock()
+	f.retired = true
+	f.onClose = onClose
+	closed := f.refs == 0
+	if closed {
+		f.close()
+	}
+	f.mu.Unlock()
+	if closed && onClose != nil {
+		onClose()
+	}
+}
+
+// close unmaps and closes the file if it is open. It must be called with f.mu
+// held.
+func (f *segmentFile) close() {
+	if f.data != nil {
+		_ = munmapFile(f.data)
+		f.data = nil
+	}
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+}
+
+func (f *segmentFile) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= int64(len(f.data)) {
+		return copy(p, f.data[off:]), nil
+	}
+	return f.file.ReadAt(p, off)
+}
+
+// section returns a reader of the file from position on.
+func (f *segmentFile) section(position int64) io.Reader {
+	return io.NewSectionReader(f, position, 1<<62)
+}
@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSegment_SharedFile(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap %v", mmap), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, 200, WithCompactionInterval(0), WithCompactionThreshold(100), WithMmap(mmap))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+				// Reads of the active segment see records appended after its
+				// file was opened.
+				if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Fatalf("Bad value of key%d returned (%v)", i, err)
+				}
+			}
+
+			sealed := db.getSegments()[0]
+			r, err := db.GetReader("key0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Compact(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(sealed.filePath); err != nil {
+				t.Errorf("Expected the compacted segment to be kept while it is read, got %v", err)
+			}
+			if _, err := sealed.readRecordAt(sealed.start); err != errSegmentClosed {
+				t.Errorf("Expected errSegmentClosed for a new read, got %v", err)
+			}
+			if value, err := io.ReadAll(r); err != nil || string(value) != "value0" {
+				t.Errorf("Bad value of key0 streamed during compaction (%v)", err)
+			}
+			r.Close()
+			if _, err := os.Stat(sealed.filePath); !os.IsNotExist(err) {
+				t.Errorf("Expected the compacted segment to be removed after the read, got %v", err)
+			}
+
+			for i := 0; i < 20; i++ {
+				if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Errorf("Bad value of key%d returned after compaction (%v)", i, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keys = 10000
+	db, err := NewDb(dir, 1<<20, WithCompactionInterval(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value of key %d", i))
+	}
+	db.Close()
+
+	// openPerRead reads records the way every Get did before segments kept
+	// their files open.
+	openPerRead := func(s *Segment, position int64) (entry, error) {
+		file, err := os.Open(s.filePath)
+		if err != nil {
+			return entry{}, err
+		}
+		defer file.Close()
+		if _, err := file.Seek(position, 0); err != nil {
+			return entry{}, err
+		}
+		return readEntry(bufio.NewReader(file), s.checksum)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		db, err := NewDb(dir, 1<<20, WithCompactionInterval(0), WithMmap(mmap))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !mmap {
+			b.Run("open per read", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					keyPos, err := db.getPos(fmt.Sprintf("key%d", i%keys))
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := openPerRead(keyPos.segment, keyPos.position); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		b.Run(fmt.Sprintf("shared file mmap %v", mmap), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("parallel mmap %v", mmap), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+		db.Close()
+	}
+}
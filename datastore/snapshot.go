@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot is released")
+
+// Snapshot is a read-only view of the database at the moment it was taken.
+// Later writes are not visible through it, and the segments it reads from are
+// kept on disk until it is released even if compaction replaces them.
+type Snapshot struct {
+	db       *Db
+	views    []segmentView
+	released atomic.Bool
+}
+
+// segmentView is a segment together with its index as of snapshot time. The
+// index of a sealed segment never changes, so it is shared; the index of the
+// segment that was active is copied.
+type segmentView struct {
+	segment *Segment
+	index   Index
+}
+
+// Snapshot captures the current state of the database. Every snapshot must be
+// released with Release.
+func (db *Db) Snapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{db: db}
+	err := db.runInPutRoutine(func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		segments := db.getSegments()
+		snapshot.views = make([]segmentView, len(segments))
+		for i, s := range segments {
+			s.mu.RLock()
+			index := s.index
+			if i == len(segments)-1 {
+				index = s.index.(hashIndex).clone()
+			}
+			s.mu.RUnlock()
+			snapshot.views[i] = segmentView{segment: s, index: index}
+		}
+		// Pinning while db.mu is held guarantees that compaction has not yet
+		// decided to remove any of these segments.
+		db.pinSegments(segments)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Release frees the snapshot allowing removal of the segments it pinned.
+// Releasing a snapshot more than once does nothing.
+func (s *Snapshot) Release() {
+	if !s.released.CompareAndSwap(false, true) {
+		return
+	}
+	segments := make([]*Segment, len(s.views))
+	for i, v := range s.views {
+		segments[i] = v.segment
+	}
+	s.db.unpinSegments(segments)
+}
+
+func (s *Snapshot) getEntry(key string) (entry, error) {
+	segment, position, err := s.lookup(key)
+	if err != nil {
+		return entry{}, err
+	}
+	e, err := segment.getFromSegment(position)
+	if err != nil {
+		return entry{}, err
+	}
+	if e.isTombstone() || e.isExpired(s.db.now()) {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+// lookup returns the segment and the position of the newest record of the
+// key at snapshot time.
+func (s *Snapshot) lookup(key string) (*Segment, int64, error) {
+	if s.released.Load() {
+		return nil, 0, ErrSnapshotReleased
+	}
+	for i := len(s.views) - 1; i >= 0; i-- {
+		v := s.views[i]
+		v.segment.mu.RLock()
+		position, ok, err := v.index.Get(key)
+		v.segment.mu.RUnlock()
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			return v.segment, position, nil
+		}
+	}
+	return nil, 0, ErrNotFound
+}
+
+// Get returns the string value the key had when the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, error) {
+	value, _, err := s.GetWithVersion(key)
+	return value, err
+}
+
+// GetInt64 returns the int64 value the key had when the snapshot was taken.
+func (s *Snapshot) GetInt64(key string) (int64, error) {
+	n, _, err := s.GetInt64WithVersion(key)
+	return n, err
+}
+
+// GetWithVersion returns a string value and its version at snapshot time.
+func (s *Snapshot) GetWithVersion(key string) (string, uint64, error) {
+	e, err := s.getEntry(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if e.valueType != TypeString {
+		return "", 0, &TypeMismatchError{Key: key, Expected: TypeString, Actual: e.valueType}
+	}
+	return e.value, e.version(), nil
+}
+
+// GetInt64WithVersion returns an int64 value and its version at snapshot
+// time.
+func (s *Snapshot) GetInt64WithVersion(key string) (int64, uint64, error) {
+	e, err := s.getEntry(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if e.valueType != TypeInt64 {
+		return 0, 0, &TypeMismatchError{Key: key, Expected: TypeInt64, Actual: e.valueType}
+	}
+	n, err := decodeInt64(e.value)
+	return n, e.version(), err
+}
+
+// GetBytes returns the binary value the key had when the snapshot was taken.
+func (s *Snapshot) GetBytes(key string) ([]byte, error) {
+	value, _, err := s.GetBytesWithVersion(key)
+	return value, err
+}
+
+// GetBytesWithVersion returns a binary value and its version at snapshot time.
+func (s *Snapshot) GetBytesWithVersion(key string) ([]byte, uint64, error) {
+	r, err := s.GetReader(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readBytes(key, r)
+}
+
+// GetReader works like Db.GetReader over the state at snapshot time.
+func (s *Snapshot) GetReader(key string) (*ValueReader, error) {
+	segment, position, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return segment.openValue(position, s.db.now())
+}
+
+// Scan works like Db.Scan over the state at snapshot time.
+func (s *Snapshot) Scan(prefix, from string, limit int) *Iterator {
+	if s.released.Load() {
+		return &Iterator{err: ErrSnapshotReleased}
+	}
+	return newIterator(from, limit, s.getEntry, func(from string) ([]indexCursor, []*Segment) {
+		cursors := make([]indexCursor, len(s.views))
+		for i, v := range s.views {
+			v.segment.mu.RLock()
+			cursors[i] = newCursor(v.index, prefix, from)
+			v.segment.mu.RUnlock()
+		}
+		// The segments are pinned, so there is nothing to read again.
+		return cursors, nil
+	})
+}
+
+// pinSegments keeps files of the segments on disk until they are unpinned.
+func (db *Db) pinSegments(segments []*Segment) {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	for _, s := range segments {
+		s.pins++
+	}
+}
+
+func (db *Db) unpinSegments(segments []*Segment) {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	for _, s := range segments {
+		s.pins--
+		if s.pins == 0 && s.removePending {
+			db.removeSegmentFiles(s)
+		}
+	}
+}
+
+// removeSegment deletes files of a segment replaced by compaction, or defers
+// that until the last snapshot reading it is released.
+func (db *Db) removeSegment(s *Segment) {
+	s.obsolete.Store(true)
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	if s.pins > 0 {
+		s.removePending = true
+		return
+	}
+	db.removeSegmentFiles(s)
+}
+
+// removeSegmentFiles deletes files of a segment once the reads still using
+// its file handle have finished.
+func (db *Db) removeSegmentFiles(s *Segment) {
+	s.retireFile(func() {
+		if err := os.Remove(s.filePath); err != nil {
+			db.opts.logger.Printf("datastore: cannot remove compacted segment: %s", err)
+		}
+		if err := os.Remove(hintPath(s.filePath)); err != nil && !os.IsNotExist(err) {
+			db.opts.logger.Printf("datastore: cannot remove hint of compacted segment: %s", err)
+		}
+		if err := os.Remove(bloomPath(s.filePath)); err != nil && !os.IsNotExist(err) {
+			db.opts.logger.Printf("datastore: cannot remove bloom filter of compacted segment: %s", err)
+		}
+		if err := os.Remove(indexPath(s.filePath)); err != nil && !os.IsNotExist(err) {
+			db.opts.logger.Printf("datastore: cannot remove index of compacted segment: %s", err)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	db.PutInt64("counter", 1)
+
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	db.Put("key1", "changed")
+	db.Delete("key2")
+	db.Put("key4", "value4")
+	db.Increment("counter", 1)
+	for i := 0; i < 5; i++ {
+		db.Put(fmt.Sprintf("other%d", i), "x")
+	}
+	if _, err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		for key, want := range map[string]string{"key1": "value1", "key2": "value2", "key3": "value3"} {
+			if value, err := snapshot.Get(key); err != nil || value != want {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", want, value, err)
+			}
+		}
+		if _, err := snapshot.Get("key4"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if n, err := snapshot.GetInt64("counter"); err != nil || n != 1 {
+			t.Errorf("Bad value returned expected 1, got %d (%v)", n, err)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "changed" {
+			t.Errorf("Bad value returned expected changed, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		expected := []string{"key1", "key2", "key3"}
+		if keys := scanKeys(t, snapshot.Scan("key", "", 0)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("release", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("Expected pinned segment to be kept: %v", err)
+		}
+		snapshot.Release()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected compacted segment to be removed after release, got %v", err)
+		}
+		if _, err := snapshot.Get("key1"); err != ErrSnapshotReleased {
+			t.Errorf("Expected ErrSnapshotReleased, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+type syncKind int
+
+const (
+	syncNone syncKind = iota
+	syncAlways
+	syncInterval
+	syncGroupCommit
+)
+
+// SyncMode defines when the active segment is flushed to stable storage.
+type SyncMode struct {
+	kind     syncKind
+	interval time.Duration
+}
+
+var (
+	// SyncNone leaves flushing to the operating system. Acknowledged writes
+	// may be lost on power failure.
+	SyncNone = SyncMode{kind: syncNone}
+	// SyncAlways calls fsync after every write before acknowledging it.
+	SyncAlways = SyncMode{kind: syncAlways}
+	// SyncGroupCommit writes all pending requests at once and acknowledges
+	// them after a single fsync.
+	SyncGroupCommit = SyncMode{kind: syncGroupCommit}
+)
+
+// SyncInterval calls fsync every d. Writes acknowledged since the last sync
+// may be lost on power failure.
+func SyncInterval(d time.Duration) SyncMode {
+	return SyncMode{kind: syncInterval, interval: d}
+}
+
+func (m SyncMode) String() string {
+	switch m.kind {
+	case syncNone:
+		return "none"
+	case syncAlways:
+		return "always"
+	case syncGroupCommit:
+		return "group"
+	case syncInterval:
+		return m.interval.String()
+	default:
+		return fmt.Sprintf("unknown(%d)", m.kind)
+	}
+}
+
+// syncsOnCommit reports whether every commit has to be followed by fsync.
+func (m SyncMode) syncsOnCommit() bool {
+	return m.kind == syncAlways || m.kind == syncGroupCommit
+}
+
+// ParseSyncMode parses the names returned by SyncMode.String: "none",
+// "always", "group" or a duration such as "100ms" for SyncInterval.
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch s {
+	case "none", "":
+		return SyncNone, nil
+	case "always":
+		return SyncAlways, nil
+	case "group":
+		return SyncGroupCommit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return SyncMode{}, fmt.Errorf("unknown sync mode %q", s)
+	}
+	return SyncInterval(d), nil
+}
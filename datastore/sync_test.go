@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDb_SyncModes(t *testing.T) {
+	const puts = 20
+	modes := []SyncMode{SyncNone, SyncAlways, SyncInterval(10 * time.Millisecond), SyncGroupCommit}
+	for _, mode := range modes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, 1000, WithSyncMode(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The first sync is held until all puts have started, so that
+			// group commit finds the waiting ones when it is done. The
+			// interval mode syncs from its ticker, which already runs.
+			var syncs, started atomic.Int32
+			if mode.kind != syncInterval {
+				db.syncFile = func(f *os.File) error {
+					if syncs.Add(1) == 1 {
+						for started.Load() < puts {
+							runtime.Gosched()
+						}
+						for i := 0; i < 100; i++ {
+							runtime.Gosched()
+						}
+					}
+					return f.Sync()
+				}
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < puts; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					started.Add(1)
+					if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			switch n := syncs.Load(); mode.kind {
+			case syncNone:
+				if n != 0 {
+					t.Errorf("Expected no syncs, got %d", n)
+				}
+			case syncAlways:
+				if n != puts {
+					t.Errorf("Expected %d syncs, got %d", puts, n)
+				}
+			case syncGroupCommit:
+				if n == 0 || n >= puts {
+					t.Errorf("Expected between 1 and %d syncs, got %d", puts-1, n)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = NewDb(dir, 1000, WithSyncMode(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < puts; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				if err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Errorf("Bad value returned expected value%d, got %s (%v)", i, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_WritesAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logged bytes.Buffer
+	db, err := NewDb(dir, 1000, WithSyncMode(SyncInterval(time.Millisecond)), WithLogger(log.New(&logged, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key", "value")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-db.putStopped:
+	default:
+		t.Error("Expected the put goroutine to stop on Close")
+	}
+
+	if err := db.Put("key", "value"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed for Put, got %v", err)
+	}
+	if _, err := db.Increment("counter", 1); err != ErrClosed {
+		t.Errorf("Expected ErrClosed for Increment, got %v", err)
+	}
+	b := new(Batch)
+	b.Put("key", "value")
+	if err := db.Write(b); err != ErrClosed {
+		t.Errorf("Expected ErrClosed for Write, got %v", err)
+	}
+	if logged.Len() > 0 {
+		t.Errorf("Unexpected log output after Close: %s", logged.String())
+	}
+}
+
+func TestParseSyncMode(t *testing.T) {
+	for _, mode := range []SyncMode{SyncNone, SyncAlways, SyncGroupCommit, SyncInterval(time.Second)} {
+		parsed, err := ParseSyncMode(mode.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != mode {
+			t.Errorf("Expected %s, got %s", mode, parsed)
+		}
+	}
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Error("Expected an error for unknown sync mode")
+	}
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// PutWithTTL stores a string value that expires after ttl. Expired keys are
+// reported as missing right away, their records are removed by compaction and
+// by the background sweeper.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return db.put(entry{
+		key:       key,
+		value:     value,
+		expiresAt: db.now().Add(ttl).UnixNano(),
+	})
+}
+
+// PutInt64WithTTL stores an int64 value that expires after ttl.
+func (db *Db) PutInt64WithTTL(key string, value int64, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return db.put(entry{
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+		expiresAt: db.now().Add(ttl).UnixNano(),
+	})
+}
+
+// PutBytesWithTTL stores a binary value that expires after ttl.
+func (db *Db) PutBytesWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return db.put(entry{
+		key:       key,
+		value:     string(value),
+		valueType: TypeBytes,
+		expiresAt: db.now().Add(ttl).UnixNano(),
+	})
+}
+
+// trackExpiry records the expiry time of a written entry for the sweeper. It
+// must only be called from the put goroutine.
+func (db *Db) trackExpiry(e *entry) {
+	if e.expiresAt != 0 {
+		db.expiries[e.key] = e.expiresAt
+	} else {
+		delete(db.expiries, e.key)
+	}
+}
+
+// earliestExpiry returns the earliest of expiry times, zero if there are none.
+func earliestExpiry(expiries map[string]int64) int64 {
+	var earliest int64
+	for _, expiresAt := range expiries {
+		if earliest == 0 || expiresAt < earliest {
+			earliest = expiresAt
+		}
+	}
+	return earliest
+}
+
+// sealedExpiries returns expiry times of keys whose newest record in the
+// sealed segment expires.
+func (s *Segment) sealedExpiries() (map[string]int64, error) {
+	s.mu.RLock()
+	expiries := s.expiries
+	s.mu.RUnlock()
+	if expiries != nil {
+		return expiries, nil
+	}
+	if d, ok := s.getIndex().(*diskIndex); ok {
+		return d.readExpiries()
+	}
+	return s.readHintExpiries()
+}
+
+// startExpirySweeper periodically deletes expired keys.
+func (db *Db) startExpirySweeper() {
+	if db.opts.expirySweepInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(db.opts.expirySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.done:
+				return
+			case <-ticker.C:
+				if err := db.runInPutRoutine(db.sweepExpired); err != nil {
+					db.opts.logger.Printf("datastore: expiry sweep failed: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// sweepExpired writes tombstones for keys whose newest record has expired.
+// Keys of the active segment are tracked in memory, those of a sealed segment
+// are read from its hint or index file once its earliest expiry time has
+// passed. It runs in the put goroutine, so a key rewritten since is checked
+// against its current record and kept if that one is still live.
+func (db *Db) sweepExpired() error {
+	now := db.now()
+	for key, expiresAt := range db.expiries {
+		if expiresAt > now.UnixNano() {
+			continue
+		}
+		if err := db.expire(key, now); err != nil {
+			return err
+		}
+	}
+
+	// Tombstones may start a new segment, which is swept next time.
+	segments := db.getSegments()
+	for _, s := range segments[:len(segments)-1] {
+		if s.nextExpiry == 0 || s.nextExpiry > now.UnixNano() {
+			continue
+		}
+		expiries, err := s.sealedExpiries()
+		if err != nil && s.obsolete.Load() {
+			// Compaction has replaced the segment meanwhile.
+			continue
+		} else if err != nil {
+			return err
+		}
+		var next int64
+		for key, expiresAt := range expiries {
+			if expiresAt > now.UnixNano() {
+				if next == 0 || expiresAt < next {
+					next = expiresAt
+				}
+				continue
+			}
+			if err := db.expire(key, now); err != nil {
+				return err
+			}
+		}
+		s.nextExpiry = next
+	}
+	return nil
+}
+
+// expire writes a tombstone for the key if its newest record has expired.
+func (db *Db) expire(key string, now time.Time) error {
+	e, err := db.getLatest(key)
+	if err == ErrNotFound {
+		delete(db.expiries, key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !e.isExpired(now) || e.isTombstone() {
+		return nil
+	}
+	return db.write(entry{key: key, kind: kindTombstone})
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDb_PutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var clock atomic.Int64
+	clock.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	open := func(t *testing.T) *Db {
+		db, err := NewDb(dir, 150, WithCompactionThreshold(100), WithCompactionInterval(0), WithExpirySweepInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.now = func() time.Time {
+			return time.Unix(0, clock.Load())
+		}
+		return db
+	}
+
+	db := open(t)
+	if err := db.PutWithTTL("session1", "a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	db.PutWithTTL("session2", "b", time.Hour)
+	db.PutWithTTL("session3", "c", time.Minute)
+	db.Put("session3", "kept")
+	db.PutInt64WithTTL("counter", 1, time.Minute)
+	clock.Add(int64(2 * time.Minute))
+
+	t.Run("expired keys are not found", func(t *testing.T) {
+		for _, key := range []string{"session1", "counter"} {
+			if _, err := db.getEntry(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+			}
+		}
+		expected := []string{"session2", "session3"}
+		if keys := scanKeys(t, db.Scan("", "", 0)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("expiries are recovered", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = open(t)
+		segments := db.getSegments()
+		if len(segments) < 2 {
+			t.Fatalf("Expected sealed segments, got %d", len(segments))
+		}
+		expiries := make(map[string]int64)
+		for _, s := range segments[:len(segments)-1] {
+			sealed, err := s.sealedExpiries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.nextExpiry != earliestExpiry(sealed) {
+				t.Errorf("Expected earliest expiry %d of %s, got %d", earliestExpiry(sealed), s.filePath, s.nextExpiry)
+			}
+			for key, expiresAt := range sealed {
+				expiries[key] = expiresAt
+			}
+		}
+		for key, expiresAt := range db.expiries {
+			expiries[key] = expiresAt
+		}
+		for _, key := range []string{"session1", "session2", "counter"} {
+			if expiries[key] == 0 {
+				t.Errorf("Expected the expiry of %s to be recovered, got %v", key, expiries)
+			}
+		}
+	})
+
+	t.Run("sweeper deletes expired keys", func(t *testing.T) {
+		if err := db.runInPutRoutine(db.sweepExpired); err != nil {
+			t.Fatal(err)
+		}
+		now := db.now().UnixNano()
+		for _, s := range db.getSegments() {
+			if s.nextExpiry != 0 && s.nextExpiry <= now {
+				t.Errorf("Expected %s to be swept, next expiry is %d", s.filePath, s.nextExpiry)
+			}
+		}
+		for _, key := range []string{"session1", "counter"} {
+			e, err := db.getLatest(key)
+			if err != nil || !e.isTombstone() {
+				t.Errorf("Expected a tombstone for %s, got %+v (%v)", key, e, err)
+			}
+		}
+		if value, err := db.Get("session2"); err != nil || value != "b" {
+			t.Errorf("Bad value returned expected b, got %s (%v)", value, err)
+		}
+		if value, err := db.Get("session3"); err != nil || value != "kept" {
+			t.Errorf("Bad value returned expected kept, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("compaction drops expired keys", func(t *testing.T) {
+		clock.Add(int64(time.Hour))
+		stats, err := db.Compact(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.KeysDropped != 3 {
+			t.Errorf("Expected 3 dropped keys, got %+v", stats)
+		}
+		expected := []string{"session3"}
+		if keys := scanKeys(t, db.Scan("", "", 0)); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+		db.Close()
+	})
+}
+
+func TestDb_MergeKeepsExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150, WithCompactionInterval(0), WithExpirySweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var clock atomic.Int64
+	clock.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	db.now = func() time.Time {
+		return time.Unix(0, clock.Load())
+	}
+
+	db.PutInt64WithTTL("visits", 1, time.Minute)
+	db.PutWithTTL("log", "a", time.Minute)
+	if n, err := db.Increment("visits", 2); err != nil || n != 3 {
+		t.Fatalf("Expected 3 visits, got %d (%v)", n, err)
+	}
+	if _, err := db.Merge("log", "b", MergeAppend); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("log"); err != nil || value != "ab" {
+		t.Errorf("Bad value returned expected ab, got %s (%v)", value, err)
+	}
+	clock.Add(int64(2 * time.Minute))
+	for _, key := range []string{"visits", "log"} {
+		if _, err := db.getEntry(key); err != ErrNotFound {
+			t.Errorf("Expected %s to expire after a merge, got %v", key, err)
+		}
+	}
+
+	// A merge into an expired key starts a new value that does not expire.
+	if n, err := db.Increment("visits", 1); err != nil || n != 1 {
+		t.Errorf("Expected 1 visit, got %d (%v)", n, err)
+	}
+	clock.Add(int64(time.Hour))
+	if n, err := db.GetInt64("visits"); err != nil || n != 1 {
+		t.Errorf("Expected 1 visit, got %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ValueType describes how the value of a record has to be interpreted.
+type ValueType byte
+
+const (
+	TypeString ValueType = iota
+	TypeInt64
+	TypeBytes
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt64:
+		return "int64"
+	case TypeBytes:
+		return "bytes"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+// ParseValueType returns the ValueType with the given name.
+func ParseValueType(name string) (ValueType, error) {
+	switch name {
+	case "string", "":
+		return TypeString, nil
+	case "int64":
+		return TypeInt64, nil
+	case "bytes":
+		return TypeBytes, nil
+	default:
+		return 0, fmt.Errorf("unknown value type %q", name)
+	}
+}
+
+// TypeMismatchError is returned when a value is read with an accessor that
+// does not match the type it was stored with.
+type TypeMismatchError struct {
+	Key      string
+	Expected ValueType
+	Actual   ValueType
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("value of %q has type %s, not %s", e.Key, e.Actual, e.Expected)
+}
+
+func encodeInt64(v int64) string {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	return string(buf[:])
+}
+
+func decodeInt64(s string) (int64, error) {
+	if len(s) != 8 {
+		return 0, fmt.Errorf("bad int64 value length %d", len(s))
+	}
+	return int64(binary.LittleEndian.Uint64([]byte(s))), nil
+}
@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Every record gets the next value of a database wide sequence number when it
+// is written. The sequence number of the newest record of a key is the version
+// of the key, so a version changes with every write and is never reused.
+// Records written before versions were introduced have no sequence number and
+// share version 1, which new records never get.
+
+const unversioned uint64 = 1
+
+// AnyVersion is an expected version that CompareAndSwap matches with any
+// version of an existing key.
+const AnyVersion uint64 = math.MaxUint64
+
+// version returns the version of the key the record holds.
+func (e *entry) version() uint64 {
+	if e.seq == 0 {
+		return unversioned
+	}
+	return e.seq
+}
+
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// VersionMismatchError is returned by CompareAndSwap when the key has a
+// version other than the expected one. Actual is zero when the key does not
+// exist. It matches ErrVersionMismatch with errors.Is.
+type VersionMismatchError struct {
+	Key      string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("version of %q is %d, expected %d", e.Key, e.Actual, e.Expected)
+}
+
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrVersionMismatch
+}
+
+// GetWithVersion returns a string value together with its version.
+func (db *Db) GetWithVersion(key string) (string, uint64, error) {
+	e, err := db.getEntry(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if e.valueType != TypeString {
+		return "", 0, &TypeMismatchError{Key: key, Expected: TypeString, Actual: e.valueType}
+	}
+	return e.value, e.version(), nil
+}
+
+// GetInt64WithVersion returns an int64 value together with its version.
+func (db *Db) GetInt64WithVersion(key string) (int64, uint64, error) {
+	e, err := db.getEntry(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if e.valueType != TypeInt64 {
+		return 0, 0, &TypeMismatchError{Key: key, Expected: TypeInt64, Actual: e.valueType}
+	}
+	n, err := decodeInt64(e.value)
+	return n, e.version(), err
+}
+
+// CompareAndSwap stores the value only if the key still has the expected
+// version and returns the new version. An expected version of zero means the
+// key must not exist, AnyVersion means it must exist.
+func (db *Db) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return db.compareAndSwap(entry{
+		key:   key,
+		value: value,
+	}, expectedVersion)
+}
+
+// CompareAndSwapInt64 is CompareAndSwap for int64 values.
+func (db *Db) CompareAndSwapInt64(key string, expectedVersion uint64, value int64) (uint64, error) {
+	return db.compareAndSwap(entry{
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+	}, expectedVersion)
+}
+
+func (db *Db) compareAndSwap(e entry, expectedVersion uint64) (uint64, error) {
+	var version uint64
+	err := db.runInPutRoutine(func() error {
+		var actual uint64
+		current, err := db.getEntry(e.key)
+		if err == nil {
+			actual = current.version()
+		} else if err != ErrNotFound {
+			return err
+		}
+		matches := actual == expectedVersion
+		if expectedVersion == AnyVersion {
+			matches = actual != 0
+		}
+		if !matches {
+			return &VersionMismatchError{Key: e.key, Expected: expectedVersion, Actual: actual}
+		}
+		if err := db.write(e); err != nil {
+			return err
+		}
+		version = db.seq.Load()
+		return nil
+	})
+	return version, err
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := db.CompareAndSwap("key", 0, "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompareAndSwap("key", 0, "value2"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for an existing key, got %v", err)
+	}
+
+	db.Put("other", "x")
+	v2, err := db.CompareAndSwap("key", v1, "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Expected version to grow, got %d after %d", v2, v1)
+	}
+
+	var mismatch *VersionMismatchError
+	if _, err := db.CompareAndSwap("key", v1, "value3"); !errors.As(err, &mismatch) || mismatch.Actual != v2 {
+		t.Errorf("Expected VersionMismatchError with actual version %d, got %v", v2, err)
+	}
+	if value, version, err := db.GetWithVersion("key"); err != nil || value != "value2" || version != v2 {
+		t.Errorf("Expected value2 at version %d, got %s at %d (%v)", v2, value, version, err)
+	}
+
+	t.Run("versions survive restart and compaction", func(t *testing.T) {
+		db.Delete("other")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, 100, WithCompactionThreshold(2), WithCompactionInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, version, err := db.GetWithVersion("key"); err != nil || version != v2 {
+			t.Errorf("Expected version %d, got %d (%v)", v2, version, err)
+		}
+		v3, err := db.CompareAndSwapInt64("counter", 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v3 != v2+2 {
+			t.Errorf("Expected version %d after the tombstone, got %d", v2+2, v3)
+		}
+		if n, version, err := db.GetInt64WithVersion("counter"); err != nil || n != 1 || version != v3 {
+			t.Errorf("Expected 1 at version %d, got %d at %d (%v)", v3, n, version, err)
+		}
+	})
+}
+
+func TestDb_CompareAndSwapUnversioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := append(legacyRecord("key1", "value1"), legacyRecord("key2", "value2")...)
+	if err := os.WriteFile(filepath.Join(dir, outFileName+"0"), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(dir, 1000, WithCompactionInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, version, err := db.GetWithVersion("key1"); err != nil || value != "value1" || version != unversioned {
+		t.Errorf("Expected value1 at version %d, got %s at %d (%v)", unversioned, value, version, err)
+	}
+	version, err := db.CompareAndSwap("key1", unversioned, "value3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == unversioned {
+		t.Errorf("Expected a new version, got %d", version)
+	}
+	if _, err := db.CompareAndSwap("key1", unversioned, "value4"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for a stale version, got %v", err)
+	}
+
+	t.Run("any version", func(t *testing.T) {
+		if _, err := db.CompareAndSwap("key2", AnyVersion, "value5"); err != nil {
+			t.Errorf("Cannot swap an unversioned key: %s", err)
+		}
+		if _, err := db.CompareAndSwap("key1", AnyVersion, "value6"); err != nil {
+			t.Errorf("Cannot swap a versioned key: %s", err)
+		}
+		var mismatch *VersionMismatchError
+		if _, err := db.CompareAndSwap("missing", AnyVersion, "value7"); !errors.As(err, &mismatch) || mismatch.Actual != 0 {
+			t.Errorf("Expected VersionMismatchError for a missing key, got %v", err)
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}